@@ -0,0 +1,132 @@
+package ssh_guard
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+// longitud maxima de la linea de identificacion incluyendo CR LF (RFC 4253 4.2)
+const maxBannerLength int = 255
+
+// tiempo que se retiene el evento conn esperando a ver el banner del cliente en el trafico
+var bannerWait = 2 * time.Second
+
+var bannerPrefix = []byte("SSH-")
+
+// evento conn retenido hasta conocer la version del cliente
+type pendingConn struct {
+	event      *sshSession
+	deadlineMs int64
+}
+
+// extrae la linea de identificacion "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13" del payload
+func parseSshBanner(payload []byte) (string, bool) {
+	if !bytes.HasPrefix(payload, bannerPrefix) {
+		return "", false
+	}
+	if len(payload) > maxBannerLength {
+		payload = payload[:maxBannerLength]
+	}
+	end := bytes.IndexByte(payload, '\n')
+	if end == -1 {
+		return "", false
+	}
+	return string(bytes.TrimRight(payload[:end], "\r")), true
+}
+
+// guarda en la sesion las versiones de cliente y servidor. Debe llamarse con el mutex cogido.
+// Si habia un evento conn esperando a la version del cliente se envia
+func (ss *SshGuard) processBanner(sessionKey string, session *sshSession, tcp *layers.TCP) {
+	if session.clientVersion != "" && session.serverVersion != "" {
+		return
+	}
+	banner, found := parseSshBanner(tcp.Payload)
+	if !found {
+		return
+	}
+	if ss.isListenPort(tcp.SrcPort) {
+		session.serverVersion = banner
+		return
+	}
+	session.clientVersion = banner
+	ss.Log.Debugf("sesión %s: cliente %q", sessionKey, banner)
+	if pending, found := ss.pendingConns[sessionKey]; found {
+		delete(ss.pendingConns, sessionKey)
+		pending.event.setVersions(session)
+		ss.addMetric(pending.event)
+	}
+}
+
+// retiene el evento conn hasta ver el banner del cliente. Devuelve false si hay que enviarlo ya:
+// la version ya se conoce o no se esta capturando trafico
+func (ss *SshGuard) deferConnEvent(sessionKey string, event *sshSession) bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if session, exists := ss.sshSessions[sessionKey]; exists && session.clientVersion != "" {
+		event.setVersions(session)
+		return false
+	}
+	if ss.offline() && ss.OfflinePcapFile == "" {
+		return false
+	}
+	ss.pendingConns[sessionKey] = &pendingConn{event: event, deadlineMs: event.tsMs + bannerWait.Milliseconds()}
+	return true
+}
+
+// envia el evento conn retenido de la sesion, para que salga antes que los siguientes eventos del log
+func (ss *SshGuard) flushPendingConn(sessionKey string) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if pending, found := ss.pendingConns[sessionKey]; found {
+		delete(ss.pendingConns, sessionKey)
+		if session, exists := ss.sshSessions[sessionKey]; exists {
+			pending.event.setVersions(session)
+		}
+		ss.addMetric(pending.event)
+	}
+}
+
+// envia sin version los eventos conn que han superado la espera (escaneos, trafico no capturado...)
+func (ss *SshGuard) flushExpiredConns(now time.Time) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	for sessionKey, pending := range ss.pendingConns {
+		if pending.deadlineMs > now.UnixMilli() {
+			continue
+		}
+		delete(ss.pendingConns, sessionKey)
+		if session, exists := ss.sshSessions[sessionKey]; exists {
+			pending.event.setVersions(session)
+		}
+		ss.addMetric(pending.event)
+	}
+}
+
+func (ss *SshGuard) checkPendingConns() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ss.done:
+			return
+		case now := <-ticker.C:
+			ss.flushExpiredConns(now)
+		}
+	}
+}
+
+func (s *sshSession) setVersions(session *sshSession) {
+	s.clientVersion = session.clientVersion
+	s.serverVersion = session.serverVersion
+}
+
+func (s *sshSession) addVersionTags(tags map[string]string) {
+	if s.clientVersion != "" {
+		tags["client_version"] = s.clientVersion
+	}
+	if s.serverVersion != "" {
+		tags["server_version"] = s.serverVersion
+	}
+}
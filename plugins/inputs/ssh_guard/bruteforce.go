@@ -0,0 +1,270 @@
+package ssh_guard
+
+import (
+	"sync"
+	"time"
+
+	system_utils "github.com/influxdata/telegraf/plugins/common/system"
+)
+
+var SSH_BRUTEFORCE eventType = "ssh_bruteforce"
+
+const (
+	BRUTEFORCE_ACTIVE  string = "active"
+	BRUTEFORCE_CLEARED string = "cleared"
+
+	BRUTEFORCE_SCOPE_IP   string = "ip"
+	BRUTEFORCE_SCOPE_USER string = "user"
+)
+
+// BruteforceConfig configura la deteccion de fuerza bruta/escaneos. Un umbral a 0 desactiva esa comprobacion
+type BruteforceConfig struct {
+	Enabled            bool   `toml:"enabled"`
+	WindowSeconds      uint64 `toml:"windowSeconds"`      //ventana deslizante en la que se cuentan los fallos
+	MaxFailuresPerIp   int    `toml:"maxFailuresPerIp"`   //fallos desde una misma ip dentro de la ventana
+	MaxFailuresPerUser int    `toml:"maxFailuresPerUser"` //fallos de un mismo usuario dentro de la ventana
+	MaxUsersPerIp      int    `toml:"maxUsersPerIp"`      //usuarios distintos probados desde una misma ip dentro de la ventana
+	CooldownSeconds    uint64 `toml:"cooldownSeconds"`    //tiempo sin fallos para dar la alerta por finalizada
+}
+
+var defaultBruteforceConfig = BruteforceConfig{
+	WindowSeconds:      60,
+	MaxFailuresPerIp:   10,
+	MaxFailuresPerUser: 10,
+	MaxUsersPerIp:      5,
+	CooldownSeconds:    300,
+}
+
+type failureRecord struct {
+	tsMs int64
+	ip   string
+	user string
+}
+
+// fallos de login de una ip o de un usuario y estado de su alerta
+type failureWindow struct {
+	failures    []failureRecord
+	alertActive bool
+	firstSeen   int64 //primer fallo de la alerta activa
+	lastSeen    int64 //ultimo fallo visto
+	total       int   //fallos acumulados durante la alerta activa
+}
+
+type bruteforceDetector struct {
+	cfg    BruteforceConfig
+	byIp   map[string]*failureWindow
+	byUser map[string]*failureWindow
+	mutex  sync.Mutex
+}
+
+// evento de alerta de fuerza bruta
+type bruteforceAlert struct {
+	scope     string //ip o user
+	key       string
+	reason    string
+	state     string
+	failures  int
+	users     int
+	ips       int
+	firstSeen int64
+	lastSeen  int64
+	tsMs      int64
+}
+
+func newBruteforceDetector(cfg BruteforceConfig) *bruteforceDetector {
+	if cfg.WindowSeconds == 0 {
+		cfg.WindowSeconds = defaultBruteforceConfig.WindowSeconds
+	}
+	if cfg.CooldownSeconds == 0 {
+		cfg.CooldownSeconds = defaultBruteforceConfig.CooldownSeconds
+	}
+	return &bruteforceDetector{
+		cfg:    cfg,
+		byIp:   make(map[string]*failureWindow),
+		byUser: make(map[string]*failureWindow),
+	}
+}
+
+// registra un fallo de login y devuelve las alertas que se activan con el
+func (bd *bruteforceDetector) addFailure(ip, user string, tsMs int64) (alerts []system_utils.SystemMetric) {
+	bd.mutex.Lock()
+	defer bd.mutex.Unlock()
+	record := failureRecord{tsMs: tsMs, ip: ip, user: user}
+	windowStart := tsMs - int64(bd.cfg.WindowSeconds)*1000
+
+	ipWindow := getFailureWindow(bd.byIp, ip)
+	ipWindow.add(record, windowStart)
+	ipReason := ""
+	if bd.cfg.MaxFailuresPerIp > 0 && len(ipWindow.failures) >= bd.cfg.MaxFailuresPerIp {
+		ipReason = "failures"
+	} else if bd.cfg.MaxUsersPerIp > 0 && ipWindow.distinctUsers() >= bd.cfg.MaxUsersPerIp {
+		ipReason = "users"
+	}
+	if alert := ipWindow.checkAlert(BRUTEFORCE_SCOPE_IP, ip, ipReason, tsMs); alert != nil {
+		alerts = append(alerts, alert)
+	}
+
+	if user == "" {
+		return
+	}
+	userWindow := getFailureWindow(bd.byUser, user)
+	userWindow.add(record, windowStart)
+	userReason := ""
+	if bd.cfg.MaxFailuresPerUser > 0 && len(userWindow.failures) >= bd.cfg.MaxFailuresPerUser {
+		userReason = "failures"
+	}
+	if alert := userWindow.checkAlert(BRUTEFORCE_SCOPE_USER, user, userReason, tsMs); alert != nil {
+		alerts = append(alerts, alert)
+	}
+	return
+}
+
+// da por finalizadas las alertas sin fallos durante el cooldown y limpia las ventanas vacias
+func (bd *bruteforceDetector) expire(nowMs int64) (cleared []system_utils.SystemMetric) {
+	bd.mutex.Lock()
+	defer bd.mutex.Unlock()
+	cleared = append(cleared, bd.expireWindows(bd.byIp, BRUTEFORCE_SCOPE_IP, nowMs)...)
+	cleared = append(cleared, bd.expireWindows(bd.byUser, BRUTEFORCE_SCOPE_USER, nowMs)...)
+	return
+}
+
+func (bd *bruteforceDetector) expireWindows(windows map[string]*failureWindow, scope string, nowMs int64) (cleared []system_utils.SystemMetric) {
+	windowStart := nowMs - int64(bd.cfg.WindowSeconds)*1000
+	for key, w := range windows {
+		w.prune(windowStart)
+		if w.alertActive && nowMs-w.lastSeen >= int64(bd.cfg.CooldownSeconds)*1000 {
+			cleared = append(cleared, &bruteforceAlert{
+				scope:     scope,
+				key:       key,
+				state:     BRUTEFORCE_CLEARED,
+				failures:  w.total,
+				firstSeen: w.firstSeen,
+				lastSeen:  w.lastSeen,
+				tsMs:      nowMs,
+			})
+			w.alertActive = false
+			w.total = 0
+		}
+		if !w.alertActive && len(w.failures) == 0 {
+			delete(windows, key)
+		}
+	}
+	return
+}
+
+func getFailureWindow(windows map[string]*failureWindow, key string) *failureWindow {
+	w, found := windows[key]
+	if !found {
+		w = &failureWindow{}
+		windows[key] = w
+	}
+	return w
+}
+
+func (w *failureWindow) add(record failureRecord, windowStart int64) {
+	w.failures = append(w.failures, record)
+	w.lastSeen = record.tsMs
+	if w.alertActive {
+		w.total++
+	}
+	w.prune(windowStart)
+}
+
+// elimina los fallos anteriores al inicio de la ventana
+func (w *failureWindow) prune(windowStart int64) {
+	i := 0
+	for i < len(w.failures) && w.failures[i].tsMs < windowStart {
+		i++
+	}
+	w.failures = w.failures[i:]
+}
+
+func (w *failureWindow) distinctUsers() int {
+	users := make(map[string]struct{})
+	for _, f := range w.failures {
+		users[f.user] = struct{}{}
+	}
+	return len(users)
+}
+
+func (w *failureWindow) distinctIps() int {
+	ips := make(map[string]struct{})
+	for _, f := range w.failures {
+		ips[f.ip] = struct{}{}
+	}
+	return len(ips)
+}
+
+// activa la alerta si se ha superado algun umbral (reason no vacio) y no estaba ya activa
+func (w *failureWindow) checkAlert(scope, key, reason string, tsMs int64) system_utils.SystemMetric {
+	if reason == "" || w.alertActive {
+		return nil
+	}
+	w.alertActive = true
+	w.firstSeen = w.failures[0].tsMs
+	w.total = len(w.failures)
+	return &bruteforceAlert{
+		scope:     scope,
+		key:       key,
+		reason:    reason,
+		state:     BRUTEFORCE_ACTIVE,
+		failures:  len(w.failures),
+		users:     w.distinctUsers(),
+		ips:       w.distinctIps(),
+		firstSeen: w.firstSeen,
+		lastSeen:  w.lastSeen,
+		tsMs:      tsMs,
+	}
+}
+
+func (ba *bruteforceAlert) TelegrafNormalize() system_utils.TelegrafEvent {
+	tags := map[string]string{
+		"group":     "SSH",
+		"eventType": string(SSH_BRUTEFORCE),
+		"scope":     ba.scope,
+		ba.scope:    ba.key,
+	}
+	if ba.reason != "" {
+		tags["reason"] = ba.reason
+	}
+	fields := map[string]interface{}{
+		"state":     ba.state,
+		"failures":  ba.failures,
+		"firstSeen": ba.firstSeen,
+		"lastSeen":  ba.lastSeen,
+	}
+	if ba.state == BRUTEFORCE_ACTIVE {
+		fields["users"] = ba.users
+		fields["ips"] = ba.ips
+	}
+	return system_utils.TelegrafEvent{
+		Fields:   fields,
+		Tags:     tags,
+		DeviceID: system_utils.GetUniqueID(),
+		Time:     time.UnixMilli(ba.tsMs),
+	}
+}
+
+// revisa periodicamente las alertas activas para finalizarlas tras el cooldown
+func (ss *SshGuard) checkBruteforceAlerts() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ss.done:
+			return
+		case now := <-ticker.C:
+			ss.expireBruteforceAlerts(now)
+		}
+	}
+}
+
+func (ss *SshGuard) expireBruteforceAlerts(now time.Time) {
+	for _, alert := range ss.bruteforce.expire(now.UnixMilli()) {
+		ss.Log.Infof("fin de alerta de fuerza bruta: %v", alert.TelegrafNormalize().Tags)
+		ss.addMetric(alert)
+	}
+	if ss.responder != nil {
+		ss.expireBlocks(now)
+	}
+}
@@ -0,0 +1,87 @@
+package ssh_guard
+
+import (
+	"time"
+
+	system_utils "github.com/influxdata/telegraf/plugins/common/system"
+)
+
+var (
+	SSH_ACTIVE_SESSIONS eventType = "active_sessions"
+	SSH_USER_SESSIONS   eventType = "user_sessions"
+)
+
+// estado actual de sshSessions que se envia en cada Gather
+type sessionsGauge struct {
+	active        int
+	authenticated int
+	preauth       int
+	tsMs          int64
+}
+
+// sesiones autenticadas de un usuario
+type userSessionsGauge struct {
+	user     string
+	sessions int
+	tsMs     int64
+}
+
+// cuenta las sesiones activas. Las marcadas para borrar ya han terminado y no se cuentan
+func (ss *SshGuard) collectSessionGauges(now time.Time) (metrics []system_utils.SystemMetric) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	total := &sessionsGauge{tsMs: now.UnixMilli()}
+	perUser := make(map[string]int)
+	for _, session := range ss.sshSessions {
+		if session.delete {
+			continue
+		}
+		total.active++
+		if !session.authenticated {
+			total.preauth++
+			continue
+		}
+		total.authenticated++
+		perUser[session.user]++
+	}
+	metrics = append(metrics, total)
+	for user, sessions := range perUser {
+		metrics = append(metrics, &userSessionsGauge{user: user, sessions: sessions, tsMs: now.UnixMilli()})
+	}
+	return
+}
+
+func (sg *sessionsGauge) TelegrafNormalize() system_utils.TelegrafEvent {
+	return system_utils.TelegrafEvent{
+		Fields: map[string]interface{}{
+			"active":        sg.active,
+			"authenticated": sg.authenticated,
+			"preauth":       sg.preauth,
+		},
+		Tags: map[string]string{
+			"group":     "SSH",
+			"eventType": string(SSH_ACTIVE_SESSIONS),
+		},
+		DeviceID: system_utils.GetUniqueID(),
+		Time:     time.UnixMilli(sg.tsMs),
+	}
+}
+
+func (ug *userSessionsGauge) TelegrafNormalize() system_utils.TelegrafEvent {
+	user := ug.user
+	if user == "" {
+		user = "unknown"
+	}
+	return system_utils.TelegrafEvent{
+		Fields: map[string]interface{}{
+			"sessions": ug.sessions,
+		},
+		Tags: map[string]string{
+			"group":     "SSH",
+			"eventType": string(SSH_USER_SESSIONS),
+			"user":      user,
+		},
+		DeviceID: system_utils.GetUniqueID(),
+		Time:     time.UnixMilli(ug.tsMs),
+	}
+}
@@ -0,0 +1,116 @@
+package ssh_guard
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+// programa y pid que escriben la linea en formato syslog: "Feb 13 14:55:12 host sshd[1234]: ..." => sshd, 1234
+var reLogProgram = regexp.MustCompile(`^\S+(?:\s+\d{1,2}\s+\d{2}:\d{2}:\d{2})?\s+\S+\s+([^\s\[:]+)(?:\[(\d+)\])?:`)
+
+// ListenPort es una instancia de sshd (o dropbear) escuchando en un puerto
+type ListenPort struct {
+	Port       uint16 `toml:"port"`
+	Label      string `toml:"label"`      //nombre de la instancia en el tag sshInstance. Por defecto el puerto
+	Identifier string `toml:"identifier"` //programa/SYSLOG_IDENTIFIER con el que la instancia escribe en el log
+}
+
+// valor del tag sshInstance
+func (lp *ListenPort) name() string {
+	if lp.Label != "" {
+		return lp.Label
+	}
+	return strconv.Itoa(int(lp.Port))
+}
+
+// resuelve las instancias configuradas. Si no hay listenPorts se usa sshListenPort
+func resolveListenPorts(configured []*ListenPort, legacyPort uint16) ([]*ListenPort, error) {
+	if len(configured) == 0 {
+		return []*ListenPort{{Port: legacyPort}}, nil
+	}
+	resolved := make([]*ListenPort, 0, len(configured))
+	for _, c := range configured {
+		if c.Port == 0 {
+			return nil, fmt.Errorf("listenPorts: puerto no valido en la instancia %q", c.Label)
+		}
+		if slices.ContainsFunc(resolved, func(lp *ListenPort) bool { return lp.Port == c.Port }) {
+			return nil, fmt.Errorf("listenPorts: puerto %d duplicado", c.Port)
+		}
+		listenPort := *c
+		resolved = append(resolved, &listenPort)
+	}
+	return resolved, nil
+}
+
+// filtro BPF con todos los puertos de sshd: "tcp and (port 22 or port 2222)"
+func buildBpfFilter(listenPorts []*ListenPort) string {
+	ports := make([]string, 0, len(listenPorts))
+	for _, lp := range listenPorts {
+		ports = append(ports, fmt.Sprintf("port %d", lp.Port))
+	}
+	return fmt.Sprintf("tcp and (%s)", strings.Join(ports, " or "))
+}
+
+func (ss *SshGuard) listenPortByNumber(port uint16) *ListenPort {
+	for _, lp := range ss.listenPorts {
+		if lp.Port == port {
+			return lp
+		}
+	}
+	return nil
+}
+
+func (ss *SshGuard) isListenPort(port layers.TCPPort) bool {
+	return ss.listenPortByNumber(uint16(port)) != nil
+}
+
+// identificadores de journald de todas las instancias que no esten ya configurados
+func (ss *SshGuard) listenPortIdentifiers() []string {
+	var identifiers []string
+	for _, lp := range ss.listenPorts {
+		if lp.Identifier != "" && !slices.Contains(identifiers, lp.Identifier) {
+			identifiers = append(identifiers, lp.Identifier)
+		}
+	}
+	return identifiers
+}
+
+// obtiene la instancia a la que pertenece una linea del log: por el puerto local si el patron lo captura,
+// por la sesion ya conocida (trafico capturado o linea de conexion) o por el programa que escribe la linea.
+// Con una sola instancia siempre es esa
+func (ss *SshGuard) listenPortForLine(line string, groups map[string]string, session *sshSession) *ListenPort {
+	if len(ss.listenPorts) == 1 {
+		return ss.listenPorts[0]
+	}
+	if rawPort, found := groups[GROUP_LOCAL_PORT]; found {
+		if port, err := strconv.ParseUint(rawPort, 10, 16); err == nil {
+			if lp := ss.listenPortByNumber(uint16(port)); lp != nil {
+				return lp
+			}
+		}
+	}
+	if session != nil && session.listenPort != nil {
+		return session.listenPort
+	}
+	if program, _ := parseLogProgram(line); program != "" {
+		for _, lp := range ss.listenPorts {
+			if lp.Identifier == program {
+				return lp
+			}
+		}
+	}
+	return nil
+}
+
+func parseLogProgram(line string) (program, pid string) {
+	matches := reLogProgram.FindStringSubmatch(line)
+	if len(matches) != 3 {
+		return "", ""
+	}
+	return matches[1], matches[2]
+}
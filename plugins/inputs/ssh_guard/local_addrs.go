@@ -0,0 +1,236 @@
+package ssh_guard
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	pcap "github.com/packetcap/go-pcap"
+	"github.com/vishvananda/netlink"
+)
+
+// nombre especial para capturar en todas las interfaces
+const ANY_INTERFACE string = "any"
+
+// espera antes de volver a suscribirse a rtnetlink si se cae la suscripcion
+var addrResubscribeDelay = 5 * time.Second
+
+// conjunto de ips locales de las interfaces monitorizadas (principales, secundarias, v4 y v6).
+// Se actualiza con las notificaciones de direcciones de rtnetlink
+type localAddrs struct {
+	mutex sync.RWMutex
+	ips   map[string]string //key = ip, value = interfaz
+}
+
+func newLocalAddrs(ips map[string]string) *localAddrs {
+	return &localAddrs{ips: ips}
+}
+
+func (la *localAddrs) contains(ip net.IP) bool {
+	la.mutex.RLock()
+	defer la.mutex.RUnlock()
+	_, found := la.ips[ip.String()]
+	return found
+}
+
+func (la *localAddrs) set(ips map[string]string) {
+	la.mutex.Lock()
+	defer la.mutex.Unlock()
+	la.ips = ips
+}
+
+// añade o elimina la ip de la interfaz. Devuelve true si el conjunto ha cambiado
+func (la *localAddrs) update(ip net.IP, iface string, added bool) bool {
+	la.mutex.Lock()
+	defer la.mutex.Unlock()
+	key := ip.String()
+	currentIface, found := la.ips[key]
+	if added && !found {
+		la.ips[key] = iface
+		return true
+	}
+	//en los borrados sin interfaz (la interfaz ya no existe) se elimina la ip directamente
+	if !added && found && (iface == "" || iface == currentIface) {
+		delete(la.ips, key)
+		return true
+	}
+	return false
+}
+
+func (la *localAddrs) list() []string {
+	la.mutex.RLock()
+	defer la.mutex.RUnlock()
+	ips := make([]string, 0, len(la.ips))
+	for ip, iface := range la.ips {
+		ips = append(ips, ip+"@"+iface)
+	}
+	return ips
+}
+
+// resuelve las interfaces configuradas. "any" se sustituye por todas las interfaces levantadas que no sean loopback
+func resolveTrackedInterfaces(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no se ha configurado ninguna interfaz en interfacesTracked")
+	}
+	var resolved []string
+	for _, name := range names {
+		if name != ANY_INTERFACE {
+			if !slices.Contains(resolved, name) {
+				resolved = append(resolved, name)
+			}
+			continue
+		}
+		interfaces, err := net.Interfaces()
+		if err != nil {
+			return nil, fmt.Errorf("error obteniendo las interfaces de red: %w", err)
+		}
+		for _, iface := range interfaces {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagLoopback == 0 && !slices.Contains(resolved, iface.Name) {
+				resolved = append(resolved, iface.Name)
+			}
+		}
+	}
+	return resolved, nil
+}
+
+// mantiene actualizadas las ips locales de las interfaces monitorizadas (DHCP, caida del enlace, ips secundarias...)
+func (ss *SshGuard) watchInterfaceAddrs() {
+	for {
+		ss.subscribeInterfaceAddrs()
+		select {
+		case <-ss.done:
+			return
+		case <-time.After(addrResubscribeDelay):
+		}
+		//tras perder la suscripcion se vuelven a leer todas las ips por si ha habido cambios mientras tanto
+		interfaces := ss.trackedInterfaces()
+		if ips, err := getIPsFromInterfaces(interfaces); err == nil {
+			ss.localAddrs.set(ips)
+			ss.Log.Infof("ips locales de %v resincronizadas: %v", interfaces, ss.localAddrs.list())
+		}
+	}
+}
+
+// procesa las notificaciones de rtnetlink hasta que se para el plugin o se cae la suscripcion
+func (ss *SshGuard) subscribeInterfaceAddrs() {
+	updates := make(chan netlink.AddrUpdate, 64)
+	done := make(chan struct{})
+	defer close(done)
+	err := netlink.AddrSubscribeWithOptions(updates, done, netlink.AddrSubscribeOptions{
+		ListExisting: true,
+		ErrorCallback: func(err error) {
+			ss.Log.Warnf("error en la suscripción de direcciones de %v: %v", ss.trackedInterfaces(), err)
+		},
+	})
+	if err != nil {
+		ss.Log.Errorf("error suscribiendo a los cambios de direcciones de %v: %v", ss.trackedInterfaces(), err)
+		return
+	}
+	for {
+		select {
+		case <-ss.done:
+			return
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			if update.LinkAddress.IP.IsLoopback() {
+				continue
+			}
+			//el indice de la interfaz puede cambiar si se recrea (ppp, wwan...), se resuelve en cada notificacion.
+			//Si la interfaz ya no existe solo se pueden procesar los borrados
+			ifaceName := ""
+			if iface, err := net.InterfaceByIndex(update.LinkIndex); err == nil {
+				ifaceName = iface.Name
+			}
+			if update.NewAddr && !slices.Contains(ss.trackedInterfaces(), ifaceName) {
+				continue
+			}
+			if ss.localAddrs.update(update.LinkAddress.IP, ifaceName, update.NewAddr) {
+				ss.Log.Infof("ips locales actualizadas (%v en %s añadida: %v): %v", update.LinkAddress.IP, ifaceName, update.NewAddr, ss.localAddrs.list())
+			}
+		}
+	}
+}
+
+// copia de las interfaces en las que se esta capturando. Con "any" cambian mientras el plugin esta arrancado
+func (ss *SshGuard) trackedInterfaces() []string {
+	ss.sniferMutex.Lock()
+	defer ss.sniferMutex.Unlock()
+	return slices.Clone(ss.interfaces)
+}
+
+// con "any" se empieza a capturar en las interfaces que se levantan despues de arrancar (modem WWAN que enumera
+// tarde, tun de una VPN...). Las que desaparecen se quitan al terminar su captura, y se vuelven a añadir si reaparecen
+func (ss *SshGuard) watchInterfaceLinks() {
+	for {
+		ss.subscribeInterfaceLinks()
+		select {
+		case <-ss.done:
+			return
+		case <-time.After(addrResubscribeDelay):
+		}
+	}
+}
+
+// procesa las notificaciones de enlaces de rtnetlink hasta que se para el plugin o se cae la suscripcion
+func (ss *SshGuard) subscribeInterfaceLinks() {
+	updates := make(chan netlink.LinkUpdate, 64)
+	done := make(chan struct{})
+	defer close(done)
+	err := netlink.LinkSubscribeWithOptions(updates, done, netlink.LinkSubscribeOptions{
+		ListExisting: true,
+		ErrorCallback: func(err error) {
+			ss.Log.Warnf("error en la suscripción de interfaces: %v", err)
+		},
+	})
+	if err != nil {
+		ss.Log.Errorf("error suscribiendo a los cambios de interfaces: %v", err)
+		return
+	}
+	for {
+		select {
+		case <-ss.done:
+			return
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			attrs := update.Link.Attrs()
+			if attrs.Flags&net.FlagUp == 0 || attrs.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			ss.addTrackedInterface(attrs.Name)
+		}
+	}
+}
+
+// empieza a capturar en una interfaz nueva y añade sus ips a las locales
+func (ss *SshGuard) addTrackedInterface(name string) {
+	ss.sniferMutex.Lock()
+	if slices.Contains(ss.interfaces, name) {
+		ss.sniferMutex.Unlock()
+		return
+	}
+	ss.interfaces = append(ss.interfaces, name)
+	ss.sniferMutex.Unlock()
+	if ips, err := getIPsFromInterface(name); err == nil {
+		for ip := range ips {
+			ss.localAddrs.update(net.ParseIP(ip), name, true)
+		}
+	}
+	ss.Log.Infof("nueva interfaz %s, iniciando captura", name)
+	go ss.snifferSshTraffic(name)
+}
+
+// quita la interfaz y su captura al terminar la captura (la interfaz ha desaparecido o no se ha podido abrir)
+func (ss *SshGuard) removeTrackedInterface(name string, handle *pcap.Handle) {
+	ss.sniferMutex.Lock()
+	defer ss.sniferMutex.Unlock()
+	ss.interfaces = slices.DeleteFunc(ss.interfaces, func(iface string) bool { return iface == name })
+	if handle != nil {
+		ss.sshSnifers = slices.DeleteFunc(ss.sshSnifers, func(h *pcap.Handle) bool { return h == handle })
+	}
+}
@@ -0,0 +1,401 @@
+package ssh_guard
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+const (
+	LOG_SOURCE_FILE     string = "file"
+	LOG_SOURCE_JOURNALD string = "journald"
+)
+
+const defaultAuditLogPath string = "/var/log/auth.log"
+
+// formato con el que se reconstruyen las lineas del journal. Es el mismo formato ISO que entiende getTsFromAuditLog
+const journalLineTimeLayout string = "2006-01-02T15:04:05.000000-07:00"
+
+// authLogReader es la fuente de lineas del log de autenticacion (fichero o journal).
+// ReadLine devuelve io.EOF cuando de momento no hay mas lineas disponibles.
+// Position devuelve la posicion tras la ultima linea entregada, para continuar desde ahi al reiniciar
+type authLogReader interface {
+	ReadLine() (string, error)
+	Position() logPosition
+	Close() error
+}
+
+// abre la fuente de log configurada desde la posicion indicada: la recuperada del fichero de estado al arrancar,
+// o la ultima linea leida al reabrir tras un error. Sin posicion se empieza por las lineas nuevas
+func (ss *SshGuard) openAuthLog(start *logPosition) (authLogReader, error) {
+	switch ss.LogSource {
+	case LOG_SOURCE_JOURNALD:
+		cursor := ""
+		if start != nil {
+			cursor = start.Cursor
+		}
+		return newJournalLogReader(ss.JournalIdentifiers, cursor)
+	default:
+		return newFileLogReader(ss.LogPath, ss.LogRotatedPath, ss.LogRotateCatchUp, start, ss.Log)
+	}
+}
+
+// lector de un fichero de log (auth.log, secure...) posicionado al final del fichero, o en la posicion guardada.
+// Detecta la rotacion del fichero (cambio de inodo o truncado por copytruncate) y reabre el nuevo fichero
+type fileLogReader struct {
+	path        string
+	rotatedPath string //fichero donde queda el log rotado, para recuperar lineas en el caso copytruncate
+	catchUp     bool   //si esta a true se leen las lineas pendientes del fichero rotado antes de pasar al nuevo
+	file        *os.File
+	inode       uint64
+	reader      *bufio.Reader
+	offset      int64    //bytes leidos del fichero actual
+	partial     string   //trozo de linea leido que aun no tiene salto de linea
+	pending     []string //lineas recuperadas del fichero rotado pendientes de entregar
+	log         telegraf.Logger
+}
+
+func newFileLogReader(path, rotatedPath string, catchUp bool, start *logPosition, log telegraf.Logger) (*fileLogReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error abriendo log %s: %w", path, err)
+	}
+	if rotatedPath == "" {
+		rotatedPath = path + ".1"
+	}
+	fr := &fileLogReader{
+		path:        path,
+		rotatedPath: rotatedPath,
+		catchUp:     catchUp,
+		file:        file,
+		inode:       fileInode(file),
+		log:         log,
+	}
+	offset, err := fr.startOffset(start)
+	if err == nil {
+		offset, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error posicionando en el log %s: %w", path, err)
+	}
+	fr.reader = bufio.NewReader(file)
+	fr.offset = offset
+	return fr, nil
+}
+
+// offset desde el que se empieza a leer. Sin posicion guardada se va al final del fichero. Si el fichero ha rotado
+// mientras el agente estaba parado se lee el nuevo desde el principio, y con catchUp tambien el resto del rotado
+func (fr *fileLogReader) startOffset(start *logPosition) (int64, error) {
+	info, err := fr.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if start == nil || start.Path != fr.path {
+		return info.Size(), nil
+	}
+	if start.Inode == fr.inode {
+		if info.Size() < start.Offset {
+			//truncado (copytruncate) mientras estaba parado
+			return 0, nil
+		}
+		fr.log.Infof("continuando el log %s desde el offset %d", fr.path, start.Offset)
+		return start.Offset, nil
+	}
+	if fr.catchUp && pathInode(fr.rotatedPath) == start.Inode {
+		fr.offset = start.Offset
+		fr.catchUpRotated()
+	}
+	fr.log.Infof("el log %s ha rotado mientras el agente estaba parado, leyendo desde el principio", fr.path)
+	return 0, nil
+}
+
+func (fr *fileLogReader) Position() logPosition {
+	return logPosition{Path: fr.path, Inode: fr.inode, Offset: fr.offset - int64(len(fr.partial))}
+}
+
+func (fr *fileLogReader) ReadLine() (string, error) {
+	if len(fr.pending) != 0 {
+		line := fr.pending[0]
+		fr.pending = fr.pending[1:]
+		return line, nil
+	}
+	line, err := fr.readFromFile()
+	if err == io.EOF {
+		//solo se comprueba la rotacion cuando se ha llegado al final del fichero actual
+		if rotErr := fr.checkRotation(); rotErr != nil {
+			return "", rotErr
+		}
+	}
+	return line, err
+}
+
+func (fr *fileLogReader) readFromFile() (string, error) {
+	line, err := fr.reader.ReadString('\n')
+	fr.offset += int64(len(line))
+	if err != nil {
+		//se guarda la linea a medio escribir para completarla en la siguiente lectura
+		fr.partial += line
+		return "", err
+	}
+	line = fr.partial + line
+	fr.partial = ""
+	return line, nil
+}
+
+// comprueba si el fichero ha sido rotado. Casos:
+//   - el path apunta a otro inodo (rotacion por rename + create): se abre el nuevo fichero desde el principio
+//   - el fichero es mas pequeño que lo leido (copytruncate): se vuelve al principio del mismo fichero
+//   - el fichero no existe (entre el rename y el create): se sigue con el descriptor actual
+func (fr *fileLogReader) checkRotation() error {
+	pathInfo, err := os.Stat(fr.path)
+	if err != nil {
+		return nil
+	}
+	currentInfo, err := fr.file.Stat()
+	if err != nil {
+		return fmt.Errorf("error obteniendo info del log %s: %w", fr.path, err)
+	}
+	if !os.SameFile(currentInfo, pathInfo) {
+		fr.log.Infof("rotación detectada en %s (cambio de inodo), reabriendo", fr.path)
+		if fr.catchUp {
+			//el descriptor antiguo sigue apuntando al fichero rotado, se leen las lineas escritas tras la ultima lectura
+			fr.drainCurrent()
+		}
+		newFile, err := os.Open(fr.path)
+		if err != nil {
+			return fmt.Errorf("error reabriendo log %s: %w", fr.path, err)
+		}
+		fr.file.Close()
+		fr.file = newFile
+		fr.inode = fileInode(newFile)
+		fr.reset()
+		return nil
+	}
+	if pathInfo.Size() < fr.offset {
+		fr.log.Infof("rotación detectada en %s (fichero truncado), leyendo desde el principio", fr.path)
+		if fr.catchUp {
+			fr.catchUpRotated()
+		}
+		if _, err := fr.file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("error posicionando al principio del log %s: %w", fr.path, err)
+		}
+		fr.reset()
+	}
+	return nil
+}
+
+// lee lo que quede en el descriptor actual y lo deja en pending
+func (fr *fileLogReader) drainCurrent() {
+	for {
+		line, err := fr.readFromFile()
+		if err != nil {
+			break
+		}
+		fr.pending = append(fr.pending, line)
+	}
+	if fr.partial != "" {
+		fr.pending = append(fr.pending, fr.partial)
+	}
+}
+
+// en copytruncate las lineas que no se llegaron a leer solo estan en la copia (rotatedPath), a partir del offset leido
+func (fr *fileLogReader) catchUpRotated() {
+	rotated, err := os.Open(fr.rotatedPath)
+	if err != nil {
+		fr.log.Warnf("no se pueden recuperar las lineas del log rotado %s: %v", fr.rotatedPath, err)
+		return
+	}
+	defer rotated.Close()
+	info, err := rotated.Stat()
+	if err != nil || info.Size() < fr.offset {
+		fr.log.Warnf("el log rotado %s no corresponde con el fichero leido, no se recuperan lineas", fr.rotatedPath)
+		return
+	}
+	if _, err := rotated.Seek(fr.offset, io.SeekStart); err != nil {
+		fr.log.Warnf("error posicionando en el log rotado %s: %v", fr.rotatedPath, err)
+		return
+	}
+	reader := bufio.NewReader(rotated)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			fr.pending = append(fr.pending, fr.partial+line)
+			fr.partial = ""
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(fr.pending) != 0 {
+		fr.log.Infof("recuperadas %d lineas del log rotado %s", len(fr.pending), fr.rotatedPath)
+	}
+}
+
+func (fr *fileLogReader) reset() {
+	fr.reader = bufio.NewReader(fr.file)
+	fr.offset = 0
+	fr.partial = ""
+}
+
+func (fr *fileLogReader) Close() error {
+	return fr.file.Close()
+}
+
+func fileInode(file *os.File) uint64 {
+	info, err := file.Stat()
+	if err != nil {
+		return 0
+	}
+	return infoInode(info)
+}
+
+func pathInode(path string) uint64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return infoInode(info)
+}
+
+func infoInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+	return 0
+}
+
+// entrada del journal en formato json (journalctl -o json). Solo los campos que se usan
+type journalEntry struct {
+	Message           string `json:"MESSAGE"`
+	RealtimeTimestamp string `json:"__REALTIME_TIMESTAMP"` //microsegundos desde epoch
+	Hostname          string `json:"_HOSTNAME"`
+	SyslogIdentifier  string `json:"SYSLOG_IDENTIFIER"`
+	SyslogPid         string `json:"SYSLOG_PID"`
+	Pid               string `json:"_PID"`
+	Cursor            string `json:"__CURSOR"`
+}
+
+// linea reconstruida del journal y cursor de su entrada
+type journalLine struct {
+	line   string
+	cursor string
+}
+
+// toSyslogLine reconstruye la linea con el mismo formato que en auth.log para reutilizar el parser de eventos
+func (je *journalEntry) toSyslogLine() string {
+	ts := time.Now()
+	if us, err := strconv.ParseInt(je.RealtimeTimestamp, 10, 64); err == nil {
+		ts = time.UnixMicro(us)
+	}
+	pid := je.SyslogPid
+	if pid == "" {
+		pid = je.Pid
+	}
+	return fmt.Sprintf("%s %s %s[%s]: %s\n", ts.Format(journalLineTimeLayout), je.Hostname, je.SyslogIdentifier, pid, je.Message)
+}
+
+// lector del journal de systemd. Lanza journalctl en modo follow filtrando por los identificadores de syslog
+type journalLogReader struct {
+	cmd    *exec.Cmd
+	lines  chan journalLine
+	errs   chan error
+	done   chan struct{}
+	exited chan struct{} //se cierra cuando readEntries deja de leer el pipe de journalctl
+	cursor string        //cursor de la ultima linea entregada
+}
+
+// sin cursor se empieza por las entradas nuevas, con cursor por las posteriores a el
+func newJournalLogReader(identifiers []string, cursor string) (*journalLogReader, error) {
+	args := []string{"--follow", "--output=json"}
+	if cursor != "" {
+		args = append(args, "--after-cursor="+cursor)
+	} else {
+		args = append(args, "--lines=0")
+	}
+	for _, identifier := range identifiers {
+		args = append(args, "--identifier="+identifier)
+	}
+	cmd := exec.Command("journalctl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creando pipe de journalctl: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error ejecutando journalctl: %w", err)
+	}
+	jr := &journalLogReader{
+		cmd:    cmd,
+		lines:  make(chan journalLine, 256),
+		errs:   make(chan error, 1),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+		cursor: cursor,
+	}
+	go jr.readEntries(stdout)
+	return jr, nil
+}
+
+func (jr *journalLogReader) readEntries(stdout io.Reader) {
+	defer close(jr.exited)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		//las entradas con MESSAGE binario (array de bytes) no son de sshd, se descartan
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		select {
+		case jr.lines <- journalLine{line: entry.toSyslogLine(), cursor: entry.Cursor}:
+		case <-jr.done:
+			return
+		}
+	}
+	err := scanner.Err()
+	if err == nil {
+		err = fmt.Errorf("journalctl finalizado")
+	}
+	jr.errs <- err
+	close(jr.lines)
+}
+
+func (jr *journalLogReader) ReadLine() (string, error) {
+	select {
+	case line, ok := <-jr.lines:
+		if !ok {
+			select {
+			case err := <-jr.errs:
+				return "", err
+			default:
+				return "", io.ErrClosedPipe
+			}
+		}
+		jr.cursor = line.cursor
+		return line.line, nil
+	default:
+		return "", io.EOF
+	}
+}
+
+func (jr *journalLogReader) Position() logPosition {
+	return logPosition{Cursor: jr.cursor}
+}
+
+// mata journalctl y espera a que readEntries termine con el pipe antes de Wait, que cierra el pipe
+func (jr *journalLogReader) Close() error {
+	close(jr.done)
+	if jr.cmd.Process != nil {
+		jr.cmd.Process.Kill()
+	}
+	<-jr.exited
+	return jr.cmd.Wait()
+}
@@ -0,0 +1,212 @@
+package ssh_guard
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+// numero magico de la cabecera de seccion de pcapng
+var pcapngMagic = []byte{0x0A, 0x0D, 0x0D, 0x0A}
+
+// en modo offline no se captura en vivo ni se sigue el log: se reproducen los ficheros grabados
+func (ss *SshGuard) offline() bool {
+	return ss.OfflinePcapFile != "" || ss.OfflineAuthLog != ""
+}
+
+// en modo offline no se descubren interfaces ni sesiones del sistema: las ips locales son las configuradas
+func (ss *SshGuard) initOffline() error {
+	localIps := make(map[string]string)
+	for _, rawIp := range ss.OfflineLocalIps {
+		ip := net.ParseIP(normalizeIP(rawIp))
+		if ip == nil {
+			return fmt.Errorf("offlineLocalIps: ip no valida %q", rawIp)
+		}
+		localIps[ip.String()] = filepath.Base(ss.OfflinePcapFile)
+	}
+	ss.localAddrs = newLocalAddrs(localIps)
+	ss.sshSessions = make(map[string]*sshSession)
+	return nil
+}
+
+// la captura offline no aplica el filtro BPF de la captura en vivo, se descarta el trafico que no es de sshd
+func (ss *SshGuard) isSshPacket(packet gopacket.Packet) bool {
+	tcp, ok := packet.TransportLayer().(*layers.TCP)
+	if !ok {
+		return false
+	}
+	return ss.isListenPort(tcp.SrcPort) || ss.isListenPort(tcp.DstPort)
+}
+
+// abre una captura pcap o pcapng
+func openOfflinePcap(path string) (*gopacket.PacketSource, io.Closer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error abriendo captura %s: %w", path, err)
+	}
+	reader := bufio.NewReader(file)
+	magic, err := reader.Peek(len(pcapngMagic))
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error leyendo captura %s: %w", path, err)
+	}
+	if bytes.Equal(magic, pcapngMagic) {
+		ngReader, err := pcapgo.NewNgReader(reader, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("error leyendo captura pcapng %s: %w", path, err)
+		}
+		return gopacket.NewPacketSource(ngReader, ngReader.LinkType()), file, nil
+	}
+	pcapReader, err := pcapgo.NewReader(reader)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error leyendo captura pcap %s: %w", path, err)
+	}
+	return gopacket.NewPacketSource(pcapReader, pcapReader.LinkType()), file, nil
+}
+
+// runOfflineReplay reproduce la captura y el log de autenticacion grabados de principio a fin, mezclando paquetes y lineas
+// en orden de timestamp. El reloj es el de los propios eventos: las estadisticas de bytes y las alertas se procesan
+// cada intervalRateSeconds de tiempo de captura, no de tiempo real
+func (ss *SshGuard) runOfflineReplay() {
+	var packetSource *gopacket.PacketSource
+	iface := ""
+	if ss.OfflinePcapFile != "" {
+		source, closer, err := openOfflinePcap(ss.OfflinePcapFile)
+		if err != nil {
+			ss.Log.Error(err)
+			return
+		}
+		defer closer.Close()
+		packetSource = source
+		iface = filepath.Base(ss.OfflinePcapFile)
+	}
+	var logReader *bufio.Reader
+	if ss.OfflineAuthLog != "" {
+		file, err := os.Open(ss.OfflineAuthLog)
+		if err != nil {
+			ss.Log.Errorf("Error abriendo log %s: %v", ss.OfflineAuthLog, err)
+			return
+		}
+		defer file.Close()
+		logReader = bufio.NewReader(file)
+	}
+	ss.Log.Infof("Reproducción offline: captura: %q | log: %q", ss.OfflinePcapFile, ss.OfflineAuthLog)
+
+	nextPacket := func() gopacket.Packet {
+		if packetSource == nil {
+			return nil
+		}
+		for {
+			packet, err := packetSource.NextPacket()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				//paquetes que no se pueden decodificar, se descartan
+				ss.Log.Debugf("error leyendo paquete de la captura: %v", err)
+				continue
+			}
+			if !ss.isSshPacket(packet) {
+				continue
+			}
+			return packet
+		}
+	}
+	nextLine := func() (string, bool) {
+		if logReader == nil {
+			return "", false
+		}
+		line, err := logReader.ReadString('\n')
+		if err != nil && line == "" {
+			return "", false
+		}
+		return line, true
+	}
+
+	interval := time.Duration(ss.IntervalRateSeconds) * time.Second
+	var clock, nextTick time.Time
+	packet := nextPacket()
+	ss.offlineYear = ss.replayYear(packet)
+	line, lineOk := nextLine()
+	var packets, lines int
+	for packet != nil || lineOk {
+		select {
+		case <-ss.done:
+			return
+		default:
+		}
+		//se procesa el evento mas antiguo. Las lineas sin hora se procesan con la hora actual del reloj.
+		//Si coinciden va antes el paquete, y las lineas siempre en el orden del fichero
+		lineTs := clock
+		if lineOk {
+			if tsMs, found := ss.lineTimestamp(line); found {
+				lineTs = time.UnixMilli(tsMs)
+			}
+		}
+		usePacket := packet != nil && (!lineOk || !packet.Metadata().Timestamp.After(lineTs))
+		eventTs := lineTs
+		if usePacket {
+			eventTs = packet.Metadata().Timestamp
+		}
+		if eventTs.After(clock) {
+			clock = eventTs
+		}
+		if nextTick.IsZero() {
+			nextTick = clock.Add(interval)
+		}
+		for !clock.Before(nextTick) {
+			ss.replayTick(nextTick)
+			nextTick = nextTick.Add(interval)
+		}
+		if usePacket {
+			ss.processPacket(packet, iface)
+			packets++
+			packet = nextPacket()
+		} else {
+			ss.processAuthLine(line)
+			lines++
+			line, lineOk = nextLine()
+		}
+	}
+	//ultimo intervalo: se envian los bytes pendientes y los resumenes de las sesiones finalizadas
+	if !nextTick.IsZero() {
+		ss.flushExpiredConns(clock.Add(bannerWait))
+		ss.replayTick(nextTick)
+	}
+	ss.Log.Infof("Reproducción offline finalizada: %d paquetes, %d lineas de log", packets, lines)
+}
+
+// año de las lineas de syslog clasico, que no lo llevan: el configurado, el del primer paquete de la captura
+// o el de la fecha de modificacion del log grabado
+func (ss *SshGuard) replayYear(firstPacket gopacket.Packet) int {
+	if ss.OfflineYear != 0 {
+		return ss.OfflineYear
+	}
+	if firstPacket != nil {
+		return firstPacket.Metadata().Timestamp.Year()
+	}
+	if info, err := os.Stat(ss.OfflineAuthLog); err == nil {
+		return info.ModTime().Year()
+	}
+	return time.Now().Year()
+}
+
+// tareas periodicas con el reloj de la reproduccion
+func (ss *SshGuard) replayTick(now time.Time) {
+	ss.flushExpiredConns(now)
+	ss.flushBytesStatistics(now)
+	if ss.bruteforce != nil {
+		ss.expireBruteforceAlerts(now)
+	}
+}
@@ -0,0 +1,221 @@
+package ssh_guard
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// dialectos de log soportados. Con auto se elige por el programa que escribe cada linea
+const (
+	DIALECT_AUTO     string = "auto"
+	DIALECT_OPENSSH  string = "openssh"
+	DIALECT_DROPBEAR string = "dropbear"
+)
+
+var logDialects = []string{DIALECT_AUTO, DIALECT_OPENSSH, DIALECT_DROPBEAR}
+
+// identificadores de journald por defecto de cada dialecto
+var dialectJournalIdentifiers = map[string][]string{
+	DIALECT_OPENSSH:  {"sshd"},
+	DIALECT_DROPBEAR: {"dropbear"},
+}
+
+// fragmento de regex que captura una ip v4 o v6 (con zona opcional, p.ej. fe80::1%eth0)
+const ipRegex string = `[0-9a-fA-F:.]+(?:%[\w.-]+)?`
+
+// grupos con nombre que se extraen de cada patron
+const (
+	GROUP_USER string = "user"
+	GROUP_IP   string = "ip"
+	GROUP_PORT string = "port"
+	// puerto local de sshd, para asociar la linea a la instancia cuando hay varias
+	GROUP_LOCAL_PORT string = "local_port"
+	// grupos opcionales de los eventos de login
+	GROUP_METHOD      string = "method"
+	GROUP_KEY_TYPE    string = "key_type"
+	GROUP_FINGERPRINT string = "fingerprint"
+	GROUP_KEY_ID      string = "key_id"
+)
+
+// eventos de sesion que pueden generar los patrones
+var authEventTypes = []eventType{
+	NEW_SSH_NEW_CONN,
+	NEW_SSH_LOGIN,
+	NEW_SSH_FAILED_LOGIN_ATTEMPT,
+	NEW_SSH_INVALID_USER,
+	NEW_SSH_FINAL_LOGIN_FAILED,
+	NEW_SSH_LOGOUT,
+	NEW_SSH_SESSION_OPENED,
+	NEW_SSH_SESSION_CLOSED,
+}
+
+// EventPattern asocia una expresion regular del log de autenticacion con un tipo de evento.
+// La regex debe tener los grupos con nombre ip y port, y opcionalmente user y local_port. Si no tiene ni ip ni port
+// la sesion se obtiene por el pid del proceso que escribe la linea (p.ej. "Exit (root): Disconnect received" de dropbear
+// o "session closed for user" de pam). Si la linea trae ip y port mandan sobre la sesion del pid.
+// En los eventos de login se usan ademas los grupos method, key_type, fingerprint y key_id si existen
+type EventPattern struct {
+	Name    string `toml:"name"`
+	Event   string `toml:"event"`
+	Regex   string `toml:"regex"`   //si esta vacio se elimina el patron por defecto con el mismo nombre
+	Dialect string `toml:"dialect"` //openssh o dropbear. Vacio para aplicarlo a todos
+	re      *regexp.Regexp
+}
+
+// patrones por defecto de OpenSSH y dropbear. El orden importa: se aplica el primero que haga match
+var defaultEventPatterns = []*EventPattern{
+	{Name: "connection", Dialect: DIALECT_OPENSSH, Event: string(NEW_SSH_NEW_CONN),
+		Regex: `Connection from (?P<ip>` + ipRegex + `) port (?P<port>\d+) on ` + ipRegex + ` port (?P<local_port>\d+)`},
+	// "Invalid user admin from 1.2.3.4 port 5555": usuario inexistente, una vez por conexion. Los intentos son las lineas
+	// "Failed password for invalid user admin" de failed_login, que son las que cuenta la deteccion de fuerza bruta
+	{Name: "invalid_user", Dialect: DIALECT_OPENSSH, Event: string(NEW_SSH_INVALID_USER),
+		Regex: `Invalid user (?P<user>\S*) from (?P<ip>` + ipRegex + `) port (?P<port>\d+)`},
+	{Name: "failed_login", Dialect: DIALECT_OPENSSH, Event: string(NEW_SSH_FAILED_LOGIN_ATTEMPT),
+		Regex: `Failed (?:password|none) for (?:invalid user )?(?P<user>\S+) from (?P<ip>` + ipRegex + `) port (?P<port>\d+)`},
+	{Name: "final_failed_login", Dialect: DIALECT_OPENSSH, Event: string(NEW_SSH_FINAL_LOGIN_FAILED),
+		Regex: `Connection closed by authenticating user (?P<user>\S+) (?P<ip>` + ipRegex + `) port (?P<port>\d+) \[preauth\]`},
+	// Caso: "error: maximum authentication attempts exceeded ... [preauth]" => fallo definitivo
+	{Name: "max_auth_exceeded", Dialect: DIALECT_OPENSSH, Event: string(NEW_SSH_FINAL_LOGIN_FAILED),
+		Regex: `error: maximum authentication attempts exceeded for (?:invalid user )?(?P<user>\S+) from (?P<ip>` + ipRegex + `) port (?P<port>\d+)(?:\s+ssh2)? \[preauth\]`},
+	// password, publickey, keyboard-interactive/pam, gssapi-with-mic... En publickey se añade el tipo y fingerprint de la clave,
+	// y si es un certificado (tipo *-CERT) el key ID: "ssh2: ED25519-CERT SHA256:xxx ID keyid (serial 1) CA ED25519 SHA256:yyy"
+	{Name: "successful_login", Dialect: DIALECT_OPENSSH, Event: string(NEW_SSH_LOGIN),
+		Regex: `Accepted (?P<method>\S+) for (?P<user>\S+) from (?P<ip>` + ipRegex + `) port (?P<port>\d+)(?: ssh2)?(?:: (?P<key_type>\S+) (?P<fingerprint>\S+)(?: ID "?(?P<key_id>.+?)"? \(serial \d+\))?)?`},
+	//desconexion para todos los casos menos para cierre abrupto cliente ¿terminus?
+	{Name: "disconnected", Dialect: DIALECT_OPENSSH, Event: string(NEW_SSH_LOGOUT),
+		Regex: `Disconnected from user (?P<user>\S+) (?P<ip>` + ipRegex + `) port (?P<port>\d+)`},
+	//desconexion sin user, se obtiene de la sesion en memoria
+	{Name: "closed", Dialect: DIALECT_OPENSSH, Event: string(NEW_SSH_LOGOUT),
+		Regex: `Connection closed by (?P<ip>` + ipRegex + `) port (?P<port>\d+)`},
+	// "pam_unix(sshd:session): session opened for user root(uid=0) by (uid=0)": sin direccion, la sesion se obtiene por el pid
+	{Name: "session_opened", Event: string(NEW_SSH_SESSION_OPENED),
+		Regex: `pam_unix\((?:sshd|dropbear):session\): session opened for user (?P<user>[^\s(]+)`},
+	{Name: "session_closed", Event: string(NEW_SSH_SESSION_CLOSED),
+		Regex: `pam_unix\((?:sshd|dropbear):session\): session closed for user (?P<user>[^\s(]+)`},
+
+	// dropbear escribe las direcciones como ip:puerto, entre <> en los mensajes de salida
+	{Name: "dropbear_connection", Dialect: DIALECT_DROPBEAR, Event: string(NEW_SSH_NEW_CONN),
+		Regex: `Child connection from \[?(?P<ip>` + ipRegex + `)\]?:(?P<port>\d+)`},
+	{Name: "dropbear_bad_password", Dialect: DIALECT_DROPBEAR, Event: string(NEW_SSH_FAILED_LOGIN_ATTEMPT),
+		Regex: `Bad password attempt for '(?P<user>[^']*)' from \[?(?P<ip>` + ipRegex + `)\]?:(?P<port>\d+)`},
+	{Name: "dropbear_nonexistent_user", Dialect: DIALECT_DROPBEAR, Event: string(NEW_SSH_FAILED_LOGIN_ATTEMPT),
+		Regex: `Login attempt for nonexistent user(?: '(?P<user>[^']*)')? from \[?(?P<ip>` + ipRegex + `)\]?:(?P<port>\d+)`},
+	{Name: "dropbear_max_auth", Dialect: DIALECT_DROPBEAR, Event: string(NEW_SSH_FINAL_LOGIN_FAILED),
+		Regex: `Exit before auth from <\[?(?P<ip>` + ipRegex + `)\]?:(?P<port>\d+)>: (?:\(user '(?P<user>[^']*)', \d+ fails\): )?Max auth tries reached`},
+	// "Password auth succeeded for 'root' from 1.2.3.4:5678"
+	// "Pubkey auth succeeded for 'root' with ssh-ed25519 key SHA256:xxx from 1.2.3.4:5678" (versiones antiguas: "with key md5 aa:bb:...")
+	{Name: "dropbear_successful_login", Dialect: DIALECT_DROPBEAR, Event: string(NEW_SSH_LOGIN),
+		Regex: `(?P<method>Password|Pubkey) auth succeeded for '(?P<user>[^']*)'(?: with (?:(?P<key_type>\S+) )?key (?:\S+ )?(?P<fingerprint>\S+))? from \[?(?P<ip>` + ipRegex + `)\]?:(?P<port>\d+)`},
+	{Name: "dropbear_exit", Dialect: DIALECT_DROPBEAR, Event: string(NEW_SSH_LOGOUT),
+		Regex: `Exit \((?P<user>[^)]+)\) from <\[?(?P<ip>` + ipRegex + `)\]?:(?P<port>\d+)>`},
+	//versiones antiguas sin direccion: la sesion se obtiene por el pid
+	{Name: "dropbear_exit_pid", Dialect: DIALECT_DROPBEAR, Event: string(NEW_SSH_LOGOUT),
+		Regex: `Exit \((?P<user>[^)]+)\): `},
+	{Name: "dropbear_exit_preauth", Dialect: DIALECT_DROPBEAR, Event: string(NEW_SSH_LOGOUT),
+		Regex: `Exit before auth from <\[?(?P<ip>` + ipRegex + `)\]?:(?P<port>\d+)>`},
+}
+
+// resultado de aplicar un patron a una linea del log
+type patternMatch struct {
+	pattern *EventPattern
+	event   eventType
+	groups  map[string]string
+}
+
+// mergeEventPatterns combina los patrones por defecto con los del usuario.
+// Un patron de usuario con el mismo nombre que uno por defecto lo sustituye (o lo elimina si la regex esta vacia),
+// el resto se añaden detras de los patrones por defecto
+func mergeEventPatterns(defaults, custom []*EventPattern) ([]*EventPattern, error) {
+	merged := make([]*EventPattern, 0, len(defaults)+len(custom))
+	for _, p := range defaults {
+		pattern := *p
+		merged = append(merged, &pattern)
+	}
+	for _, c := range custom {
+		if c.Name == "" {
+			return nil, fmt.Errorf("patrón sin nombre: %q", c.Regex)
+		}
+		idx := slices.IndexFunc(merged, func(p *EventPattern) bool { return p.Name == c.Name })
+		pattern := *c
+		switch {
+		case idx == -1 && pattern.Regex == "":
+			return nil, fmt.Errorf("patrón %q sin regex", c.Name)
+		case idx == -1:
+			merged = append(merged, &pattern)
+		case pattern.Regex == "":
+			merged = slices.Delete(merged, idx, idx+1)
+		default:
+			merged[idx] = &pattern
+		}
+	}
+	for _, p := range merged {
+		if err := p.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+func (p *EventPattern) compile() error {
+	if p.Dialect != "" && (p.Dialect == DIALECT_AUTO || !slices.Contains(logDialects, p.Dialect)) {
+		return fmt.Errorf("patrón %q: dialecto %q no soportado. Valores posibles: %q, %q", p.Name, p.Dialect, DIALECT_OPENSSH, DIALECT_DROPBEAR)
+	}
+	if !slices.Contains(authEventTypes, eventType(p.Event)) {
+		return fmt.Errorf("patrón %q: evento %q no soportado. Valores posibles: %v", p.Name, p.Event, authEventTypes)
+	}
+	re, err := regexp.Compile(p.Regex)
+	if err != nil {
+		return fmt.Errorf("patrón %q: regex no valida: %w", p.Name, err)
+	}
+	//ip y port van juntos: o los dos o ninguno (sesion por pid)
+	if (re.SubexpIndex(GROUP_IP) == -1) != (re.SubexpIndex(GROUP_PORT) == -1) {
+		return fmt.Errorf("patrón %q: los grupos con nombre %q y %q deben ir juntos", p.Name, GROUP_IP, GROUP_PORT)
+	}
+	p.re = re
+	return nil
+}
+
+// busca el primer patron del dialecto que haga match con la linea
+func matchEventPatterns(patterns []*EventPattern, dialect, line string) *patternMatch {
+	for _, p := range patterns {
+		if p.Dialect != "" && p.Dialect != dialect {
+			continue
+		}
+		matches := p.re.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+		groups := make(map[string]string)
+		for i, name := range p.re.SubexpNames() {
+			if name != "" && matches[i] != "" {
+				groups[name] = matches[i]
+			}
+		}
+		if ip, found := groups[GROUP_IP]; found {
+			groups[GROUP_IP] = normalizeIP(ip)
+		}
+		return &patternMatch{pattern: p, event: eventType(p.Event), groups: groups}
+	}
+	return nil
+}
+
+// dialecto de una linea del log. En modo auto se decide por el programa que la escribe
+func lineDialect(configured, line string) string {
+	if configured != DIALECT_AUTO {
+		return configured
+	}
+	if program, _ := parseLogProgram(line); strings.HasPrefix(program, "dropbear") {
+		return DIALECT_DROPBEAR
+	}
+	return DIALECT_OPENSSH
+}
+
+// identificadores de journald por defecto del dialecto configurado
+func defaultDialectIdentifiers(dialect string) []string {
+	if dialect == DIALECT_AUTO {
+		return append(slices.Clone(dialectJournalIdentifiers[DIALECT_OPENSSH]), dialectJournalIdentifiers[DIALECT_DROPBEAR]...)
+	}
+	return dialectJournalIdentifiers[dialect]
+}
@@ -0,0 +1,184 @@
+package ssh_guard
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	system_utils "github.com/influxdata/telegraf/plugins/common/system"
+)
+
+var SSH_PRIVILEGE_ESCALATION eventType = "privilege_escalation"
+
+const (
+	ESCALATION_SUDO string = "sudo"
+	ESCALATION_SU   string = "su"
+)
+
+// identificadores de journald de sudo y su
+var privilegeJournalIdentifiers = []string{ESCALATION_SUDO, ESCALATION_SU}
+
+// "sudo: alice : TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/usr/bin/apt update"
+// "sudo: alice : 3 incorrect password attempts ; TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/bin/ls"
+// "sudo: alice : user NOT in sudoers ; TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/bin/ls"
+var reSudo = regexp.MustCompile(`:\s+(?P<user>\S+) : (?:(?P<error>[^;]+?) ; )?TTY=(?P<tty>\S+) ; PWD=.*? ; USER=(?P<target>\S+) ;.*? COMMAND=(?P<command>.*?)\s*$`)
+
+// "su: (to root) alice on pts/0", "su[1234]: FAILED SU (to root) alice on pts/0"
+var reSu = regexp.MustCompile(`:\s+(?P<failed>FAILED SU )?\(to (?P<target>\S+)\) (?P<user>\S+) on (?P<tty>\S+)`)
+
+// ejecucion de sudo o sesion de su, asociada si es posible a la sesion SSH del terminal
+type privilegeEscalation struct {
+	method     string
+	user       string
+	targetUser string
+	command    string
+	tty        string
+	success    bool
+	reason     string //motivo del fallo de sudo
+	session    *sshSession
+	tsMs       int64
+}
+
+// parsea las lineas de sudo y su. Devuelve nil si la linea no es de escalado de privilegios
+func parsePrivilegeEscalation(line string, tsMs int64) *privilegeEscalation {
+	program, _ := parseLogProgram(line)
+	var re *regexp.Regexp
+	switch program {
+	case ESCALATION_SUDO:
+		re = reSudo
+	case ESCALATION_SU:
+		re = reSu
+	default:
+		return nil
+	}
+	matches := re.FindStringSubmatch(line)
+	if matches == nil {
+		return nil
+	}
+	group := func(name string) string {
+		return matches[re.SubexpIndex(name)]
+	}
+	escalation := &privilegeEscalation{
+		method:     program,
+		user:       group("user"),
+		targetUser: group("target"),
+		tty:        normalizeTty(group("tty")),
+		tsMs:       tsMs,
+	}
+	if program == ESCALATION_SUDO {
+		escalation.command = group("command")
+		escalation.reason = group("error")
+		escalation.success = escalation.reason == ""
+	} else {
+		escalation.success = group("failed") == ""
+	}
+	return escalation
+}
+
+// "/dev/pts/0" => "pts/0". Sin terminal => vacio
+func normalizeTty(tty string) string {
+	tty = strings.TrimPrefix(tty, "/dev/")
+	if tty == "unknown" || tty == "none" || tty == "???" {
+		return ""
+	}
+	return tty
+}
+
+// busca la sesion SSH que tiene el terminal. Si no se conoce se vuelve a leer /proc, que tiene el terminal en el
+// titulo del proceso sshd de la sesion, y se guarda en las sesiones en memoria
+func (ss *SshGuard) findSessionByTty(tty string) *sshSession {
+	if !strings.HasPrefix(tty, "pts/") {
+		return nil
+	}
+	if session := ss.sessionWithTty(tty); session != nil {
+		return session
+	}
+	if ss.offline() {
+		return nil
+	}
+	live := ss.getActiveSSHSessions()
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	var found *sshSession
+	for key, liveSession := range live {
+		session, exists := ss.sshSessions[key]
+		if !exists || liveSession.tty == "" {
+			continue
+		}
+		session.tty = liveSession.tty
+		if session.tty == tty {
+			copied := *session
+			found = &copied
+		}
+	}
+	return found
+}
+
+// copia de la sesion en memoria con el terminal, para no compartir la sesion fuera del mutex
+func (ss *SshGuard) sessionWithTty(tty string) *sshSession {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	for _, session := range ss.sshSessions {
+		if session.tty == tty && !session.delete {
+			copied := *session
+			return &copied
+		}
+	}
+	return nil
+}
+
+func (pe *privilegeEscalation) TelegrafNormalize() system_utils.TelegrafEvent {
+	tags := map[string]string{
+		"group":      "SSH",
+		"eventType":  string(SSH_PRIVILEGE_ESCALATION),
+		"method":     pe.method,
+		"user":       pe.user,
+		"targetUser": pe.targetUser,
+	}
+	if pe.tty != "" {
+		tags["tty"] = pe.tty
+	}
+	fields := map[string]interface{}{
+		"success": pe.success,
+	}
+	if pe.command != "" {
+		fields["command"] = pe.command
+	}
+	if pe.reason != "" {
+		fields["reason"] = pe.reason
+	}
+	if pe.session != nil {
+		tags["ip"] = pe.session.ip
+		tags["port"] = pe.session.port
+		if pe.session.user != "" {
+			tags["sshUser"] = pe.session.user
+		}
+		if pe.session.listenPort != nil {
+			tags["sshInstance"] = pe.session.listenPort.name()
+		}
+	}
+	return system_utils.TelegrafEvent{
+		Fields:   fields,
+		Tags:     tags,
+		DeviceID: system_utils.GetUniqueID(),
+		Time:     time.UnixMilli(pe.tsMs),
+	}
+}
+
+// procesa la linea si es de sudo/su. Devuelve true si lo era
+func (ss *SshGuard) processPrivilegeLine(line string, tsMs int64) bool {
+	escalation := parsePrivilegeEscalation(line, tsMs)
+	if escalation == nil {
+		return false
+	}
+	escalation.session = ss.findSessionByTty(escalation.tty)
+	sessionKey := ""
+	if escalation.session != nil {
+		sessionKey = net.JoinHostPort(escalation.session.ip, escalation.session.port)
+	}
+	ss.Log.Infof("Escalado de privilegios (%s): %s -> %s | tty: %q | sesión: %q | éxito: %v | comando: %q",
+		escalation.method, escalation.user, escalation.targetUser, escalation.tty, sessionKey, escalation.success, escalation.command)
+	ss.addMetric(escalation)
+	return true
+}
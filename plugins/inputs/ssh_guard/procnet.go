@@ -0,0 +1,345 @@
+package ssh_guard
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const defaultProcRoot string = "/proc"
+
+// ticks por segundo de los tiempos de /proc/<pid>/stat (USER_HZ). 100 en todas las arquitecturas soportadas
+const clockTicksPerSecond int64 = 100
+
+// estado ESTABLISHED en /proc/net/tcp*
+const tcpStateEstablished string = "01"
+
+// titulo de proceso de sshd: "sshd: root@pts/0", "sshd: user [priv]", "sshd-session: user@notty"...
+var reSshdProcTitle = regexp.MustCompile(`^sshd(?:-session)?: ([^\s@]+)(?:@\S+|\s+\[priv\])?\s*$`)
+
+// terminal de la sesion en el titulo del proceso: "sshd: root@pts/0" => pts/0
+var reSshdTty = regexp.MustCompile(`^sshd(?:-session)?: [^\s@]+@(\S+)`)
+
+// socket tcp establecido leido de /proc/net/tcp o /proc/net/tcp6
+type procSocket struct {
+	localIp    net.IP
+	localPort  uint16
+	remoteIp   net.IP
+	remotePort uint16
+	inode      string
+}
+
+// proceso sshd dueño de un socket
+type sshdProcess struct {
+	pid       int
+	title     string
+	uid       int
+	startTsMs int64 //0 si no se conoce
+}
+
+// getActiveSSHSessions obtiene las sesiones SSH activas a partir de /proc: sockets establecidos en el puerto de sshd
+// cuyo inodo pertenece a un proceso sshd. El usuario se obtiene del titulo del proceso o de su propietario
+func (ss *SshGuard) getActiveSSHSessions() (sessions map[string]*sshSession) {
+	sessions = make(map[string]*sshSession)
+	var sockets []procSocket
+	for _, table := range []string{"tcp", "tcp6"} {
+		tableSockets, err := readProcNetTcp(filepath.Join(ss.ProcRoot, "net", table))
+		if err != nil {
+			//tcp6 no existe si el kernel no tiene ipv6
+			ss.Log.Debugf("no se puede leer /proc/net/%s: %v", table, err)
+			continue
+		}
+		sockets = append(sockets, tableSockets...)
+	}
+	sshdSockets := make(map[string]procSocket)
+	for _, socket := range sockets {
+		if ss.listenPortByNumber(socket.localPort) != nil {
+			sshdSockets[socket.inode] = socket
+		}
+	}
+	if len(sshdSockets) == 0 {
+		return sessions
+	}
+	bootTsMs, err := readBootTime(ss.ProcRoot)
+	if err != nil {
+		ss.Log.Warnf("no se conoce el arranque del sistema, las sesiones descubiertas empiezan ahora: %v", err)
+	}
+	owners, err := findSocketOwners(ss.ProcRoot, sshdSockets, bootTsMs)
+	if err != nil {
+		ss.Log.Errorf("Error buscando los procesos sshd: %v", err)
+		return sessions
+	}
+	nowMs := time.Now().UnixMilli()
+	for inode, socket := range sshdSockets {
+		processes, found := owners[inode]
+		if !found {
+			continue
+		}
+		ip := socket.remoteIp.String()
+		port := strconv.Itoa(int(socket.remotePort))
+		//inicio de la sesion: el del proceso sshd de la conexion, el login el del proceso de la sesion
+		startTsMs, loginTsMs := getSshdSessionTimes(processes)
+		if startTsMs == 0 {
+			startTsMs = nowMs
+		}
+		session := newTrackedSession(ip, port, startTsMs)
+		session.loginTsMs = loginTsMs
+		//la ultima actividad no se conoce: se cuenta desde ahora para no avisar de inactividad sin haber visto trafico
+		session.lastActivityMs = nowMs
+		session.user = getSshdSessionUser(processes)
+		session.authenticated = isSshdSessionAuthenticated(processes)
+		session.tty = getSshdSessionTty(processes)
+		session.pid = getSshdSessionPid(processes)
+		session.listenPort = ss.listenPortByNumber(socket.localPort)
+		sessions[net.JoinHostPort(ip, port)] = session
+	}
+	return sessions
+}
+
+// lee los sockets establecidos de una tabla de /proc/net (tcp o tcp6)
+func readProcNetTcp(path string) ([]procSocket, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var sockets []procSocket
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // cabecera
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != tcpStateEstablished {
+			continue
+		}
+		localIp, localPort, err := parseProcNetAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("error en %s: %w", path, err)
+		}
+		remoteIp, remotePort, err := parseProcNetAddr(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("error en %s: %w", path, err)
+		}
+		sockets = append(sockets, procSocket{
+			localIp:    localIp,
+			localPort:  localPort,
+			remoteIp:   remoteIp,
+			remotePort: remotePort,
+			inode:      fields[9],
+		})
+	}
+	return sockets, scanner.Err()
+}
+
+// parsea una direccion de /proc/net/tcp* ("0100007F:0016"). La ip esta en palabras de 32 bits en el orden
+// de bytes del host (little endian en todas las arquitecturas soportadas) y el puerto en hexadecimal
+func parseProcNetAddr(raw string) (net.IP, uint16, error) {
+	hexIp, hexPort, found := strings.Cut(raw, ":")
+	if !found {
+		return nil, 0, fmt.Errorf("dirección no valida %q", raw)
+	}
+	ipBytes, err := hex.DecodeString(hexIp)
+	if err != nil || (len(ipBytes) != net.IPv4len && len(ipBytes) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("ip no valida %q", hexIp)
+	}
+	for i := 0; i < len(ipBytes); i += 4 {
+		ipBytes[i], ipBytes[i+1], ipBytes[i+2], ipBytes[i+3] = ipBytes[i+3], ipBytes[i+2], ipBytes[i+1], ipBytes[i]
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("puerto no valido %q", hexPort)
+	}
+	return net.IP(ipBytes), uint16(port), nil
+}
+
+// recorre /proc/<pid>/fd de los procesos sshd buscando los inodos de los sockets. key = inodo
+func findSocketOwners(procRoot string, sockets map[string]procSocket, bootTsMs int64) (map[string][]sshdProcess, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string][]sshdProcess)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		pidDir := filepath.Join(procRoot, entry.Name())
+		comm, err := os.ReadFile(filepath.Join(pidDir, "comm"))
+		if err != nil || !isSshdComm(strings.TrimSpace(string(comm))) {
+			continue
+		}
+		fds, err := os.ReadDir(filepath.Join(pidDir, "fd"))
+		if err != nil {
+			continue
+		}
+		var process *sshdProcess
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(pidDir, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+			if _, found := sockets[inode]; !found {
+				continue
+			}
+			if process == nil {
+				process = readSshdProcess(pidDir, pid, bootTsMs)
+			}
+			owners[inode] = append(owners[inode], *process)
+		}
+	}
+	return owners, nil
+}
+
+// procesos de OpenSSH (sshd, sshd-session) o de dropbear
+func isSshdComm(comm string) bool {
+	return strings.HasPrefix(comm, "sshd") || strings.HasPrefix(comm, "dropbear")
+}
+
+func readSshdProcess(pidDir string, pid int, bootTsMs int64) *sshdProcess {
+	process := &sshdProcess{pid: pid, uid: -1}
+	//el titulo del proceso sshd se sobrescribe en cmdline, separado por \0
+	if cmdline, err := os.ReadFile(filepath.Join(pidDir, "cmdline")); err == nil {
+		process.title = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+	if info, err := os.Stat(pidDir); err == nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			process.uid = int(stat.Uid)
+		}
+	}
+	if bootTsMs != 0 {
+		if ticks, err := readProcessStartTicks(pidDir); err == nil {
+			process.startTsMs = bootTsMs + ticks*1000/clockTicksPerSecond
+		}
+	}
+	return process
+}
+
+// hora de arranque del sistema en ms: btime de /proc/stat
+func readBootTime(procRoot string) (int64, error) {
+	file, err := os.Open(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), "btime "); found {
+			btime, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("btime no valido %q", value)
+			}
+			return btime * 1000, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no hay btime en %s", file.Name())
+}
+
+// starttime (campo 22) de /proc/<pid>/stat: ticks desde el arranque del sistema. Se cuenta desde el ultimo ')'
+// porque el nombre del proceso (campo 2) puede tener espacios y parentesis
+func readProcessStartTicks(pidDir string) (int64, error) {
+	stat, err := os.ReadFile(filepath.Join(pidDir, "stat"))
+	if err != nil {
+		return 0, err
+	}
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return 0, fmt.Errorf("%s no valido", filepath.Join(pidDir, "stat"))
+	}
+	//campos desde el 3 (state)
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("%s no valido", filepath.Join(pidDir, "stat"))
+	}
+	return strconv.ParseInt(fields[19], 10, 64)
+}
+
+// inicio de la conexion (el proceso sshd mas antiguo, que la acepto) y del login (el proceso de la sesion,
+// "sshd: user@pts/0", que se crea tras autenticarse). 0 si no se conocen
+func getSshdSessionTimes(processes []sshdProcess) (startTsMs, loginTsMs int64) {
+	for _, process := range processes {
+		if process.startTsMs == 0 {
+			continue
+		}
+		if startTsMs == 0 || process.startTsMs < startTsMs {
+			startTsMs = process.startTsMs
+		}
+		if reSshdProcTitle.MatchString(process.title) && strings.Contains(process.title, "@") {
+			loginTsMs = process.startTsMs
+		}
+	}
+	return startTsMs, loginTsMs
+}
+
+// tras el login sshd crea el proceso de la sesion con titulo "sshd: user@pts/0" o "sshd: user@notty".
+// Dropbear no cambia el titulo, sus sesiones se cuentan como preauth hasta que se vea el login
+func isSshdSessionAuthenticated(processes []sshdProcess) bool {
+	for _, process := range processes {
+		if reSshdProcTitle.MatchString(process.title) && strings.Contains(process.title, "@") {
+			return true
+		}
+	}
+	return false
+}
+
+// terminal asignado a la sesion. Vacio en las sesiones sin terminal (notty: scp, sftp, ssh host comando...)
+func getSshdSessionTty(processes []sshdProcess) string {
+	for _, process := range processes {
+		if matches := reSshdTty.FindStringSubmatch(process.title); len(matches) == 2 && matches[1] != "notty" {
+			return matches[1]
+		}
+	}
+	return ""
+}
+
+// pid del proceso que escribe en el log los eventos de la sesion: en OpenSSH el monitor ("sshd: user [priv]"),
+// que es el que escribe el login y la apertura y cierre de la sesion de pam. Si no hay monitor, el de pid menor
+func getSshdSessionPid(processes []sshdProcess) string {
+	pid := 0
+	for _, process := range processes {
+		if strings.HasSuffix(process.title, "[priv]") {
+			return strconv.Itoa(process.pid)
+		}
+		if pid == 0 || process.pid < pid {
+			pid = process.pid
+		}
+	}
+	if pid == 0 {
+		return ""
+	}
+	return strconv.Itoa(pid)
+}
+
+// obtiene el usuario de la sesion: primero del titulo de los procesos sshd ("sshd: user@pts/0", "sshd: user [priv]"),
+// y si no del propietario del proceso sin privilegios de la sesion
+func getSshdSessionUser(processes []sshdProcess) string {
+	for _, process := range processes {
+		if matches := reSshdProcTitle.FindStringSubmatch(process.title); len(matches) == 2 && matches[1] != "unknown" {
+			return matches[1]
+		}
+	}
+	for _, process := range processes {
+		if process.uid <= 0 {
+			continue
+		}
+		if u, err := user.LookupId(strconv.Itoa(process.uid)); err == nil {
+			return u.Username
+		}
+		return strconv.Itoa(process.uid)
+	}
+	return ""
+}
@@ -0,0 +1,364 @@
+package ssh_guard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	system_utils "github.com/influxdata/telegraf/plugins/common/system"
+)
+
+var SSH_BLOCK eventType = "ssh_block"
+
+const (
+	RESPONSE_NFTABLES string = "nftables"
+	RESPONSE_IPTABLES string = "iptables"
+	RESPONSE_COMMAND  string = "command"
+
+	BLOCK_ACTION_BLOCK   string = "block"
+	BLOCK_ACTION_UNBLOCK string = "unblock"
+)
+
+var responseBackends = []string{RESPONSE_NFTABLES, RESPONSE_IPTABLES, RESPONSE_COMMAND}
+
+// tiempo maximo de ejecucion de cada comando de bloqueo
+var responseCommandTimeout = 10 * time.Second
+
+// acciones pendientes de ejecutar. Si se llena (backend colgado) se descartan los bloqueos nuevos
+const responseQueueSize int = 256
+
+// ResponseConfig configura la respuesta activa: bloquear las ips que generan alertas de fuerza bruta.
+// Los bloqueos los elimina el agente al expirar y al parar el plugin. En nftables los elementos se añaden con
+// timeout, y en iptables y command se guardan en stateFile para eliminarlos al arrancar si el agente se cayo
+type ResponseConfig struct {
+	Enabled      bool     `toml:"enabled"`
+	DryRun       bool     `toml:"dryRun"`       //solo se registra la accion, no se ejecuta
+	Backend      string   `toml:"backend"`      //nftables, iptables o command
+	BlockSeconds uint64   `toml:"blockSeconds"` //duracion del bloqueo
+	Allowlist    []string `toml:"allowlist"`    //redes que nunca se bloquean
+	//nftables: sets ya creados (type ipv4_addr / ipv6_addr, flags timeout) referenciados desde una regla de drop
+	NftFamily string `toml:"nftFamily"`
+	NftTable  string `toml:"nftTable"`
+	NftSet    string `toml:"nftSet"`
+	NftSet6   string `toml:"nftSet6"`
+	//iptables/ip6tables: cadena ya creada y enlazada desde INPUT
+	IptablesChain string `toml:"iptablesChain"`
+	//command: argumentos del comando, se sustituyen {ip}, {seconds} y {reason}. Se ejecuta sin shell
+	BlockCommand   []string `toml:"blockCommand"`
+	UnblockCommand []string `toml:"unblockCommand"`
+}
+
+var defaultResponseConfig = ResponseConfig{
+	Backend:       RESPONSE_NFTABLES,
+	BlockSeconds:  3600,
+	NftFamily:     "inet",
+	NftTable:      "filter",
+	NftSet:        "ssh_guard_block",
+	NftSet6:       "ssh_guard_block6",
+	IptablesChain: "SSH_GUARD",
+}
+
+type activeBlock struct {
+	reason  string
+	sinceMs int64
+	untilMs int64
+}
+
+type responder struct {
+	cfg       ResponseConfig
+	allowlist []*net.IPNet
+	blocks    map[string]*activeBlock //key = ip
+	mutex     sync.Mutex
+	actions   chan *blockAction //los comandos se ejecutan en runBlockActions, fuera de los mutex de las sesiones
+	stopped   chan struct{}
+}
+
+// bloqueo o desbloqueo pendiente de ejecutar
+type blockAction struct {
+	action  string
+	ip      net.IP
+	reason  string
+	untilMs int64
+	expired bool //desbloqueo por expiracion, no por parada
+	tsMs    int64
+}
+
+// evento de bloqueo/desbloqueo de una ip
+type blockEvent struct {
+	action  string
+	ip      string
+	reason  string
+	backend string
+	dryRun  bool
+	success bool
+	err     string
+	untilMs int64
+	tsMs    int64
+}
+
+func newResponder(cfg ResponseConfig) (*responder, error) {
+	if !slices.Contains(responseBackends, cfg.Backend) {
+		return nil, fmt.Errorf("response: backend %q no soportado. Valores posibles: %q", cfg.Backend, responseBackends)
+	}
+	if cfg.BlockSeconds == 0 {
+		cfg.BlockSeconds = defaultResponseConfig.BlockSeconds
+	}
+	if cfg.Backend == RESPONSE_COMMAND && (len(cfg.BlockCommand) == 0 || len(cfg.UnblockCommand) == 0) {
+		return nil, fmt.Errorf("response: el backend %q necesita blockCommand y unblockCommand", RESPONSE_COMMAND)
+	}
+	r := &responder{
+		cfg:     cfg,
+		blocks:  make(map[string]*activeBlock),
+		actions: make(chan *blockAction, responseQueueSize),
+		stopped: make(chan struct{}),
+	}
+	for _, cidr := range cfg.Allowlist {
+		ipNet, err := parseZoneCidr(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("response: allowlist: %w", err)
+		}
+		r.allowlist = append(r.allowlist, ipNet)
+	}
+	return r, nil
+}
+
+func (r *responder) allowed(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, ipNet := range r.allowlist {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// comando que bloquea o desbloquea la ip en el backend configurado
+func (r *responder) command(action string, ip net.IP, reason string, seconds uint64) []string {
+	cfg := r.cfg
+	switch cfg.Backend {
+	case RESPONSE_NFTABLES:
+		set := cfg.NftSet
+		if ip.To4() == nil {
+			set = cfg.NftSet6
+		}
+		if action == BLOCK_ACTION_UNBLOCK {
+			return []string{"nft", "delete", "element", cfg.NftFamily, cfg.NftTable, set, "{ " + ip.String() + " }"}
+		}
+		//el kernel elimina el elemento al expirar aunque el agente no este corriendo
+		return []string{"nft", "add", "element", cfg.NftFamily, cfg.NftTable, set, fmt.Sprintf("{ %s timeout %ds }", ip, seconds)}
+	case RESPONSE_IPTABLES:
+		binary := "iptables"
+		if ip.To4() == nil {
+			binary = "ip6tables"
+		}
+		flag := "-I"
+		if action == BLOCK_ACTION_UNBLOCK {
+			flag = "-D"
+		}
+		return []string{binary, "-w", flag, cfg.IptablesChain, "-s", ip.String(), "-j", "DROP"}
+	default:
+		template := cfg.BlockCommand
+		if action == BLOCK_ACTION_UNBLOCK {
+			template = cfg.UnblockCommand
+		}
+		replacer := strings.NewReplacer("{ip}", ip.String(), "{seconds}", strconv.FormatUint(seconds, 10), "{reason}", reason)
+		args := make([]string, 0, len(template))
+		for _, arg := range template {
+			args = append(args, replacer.Replace(arg))
+		}
+		return args
+	}
+}
+
+// ejecuta las acciones encoladas hasta que se para el plugin
+func (ss *SshGuard) runBlockActions() {
+	r := ss.responder
+	defer close(r.stopped)
+	for {
+		select {
+		case <-ss.done:
+			return
+		case action := <-r.actions:
+			ss.applyBlockAction(action)
+		}
+	}
+}
+
+// encola la accion sin bloquear: se llama con los mutex de las sesiones cogidos
+func (ss *SshGuard) queueBlockAction(action *blockAction) {
+	r := ss.responder
+	select {
+	case r.actions <- action:
+	default:
+		ss.Log.Errorf("cola de respuesta llena, se descarta %s de %s", action.action, action.ip)
+		if action.action == BLOCK_ACTION_BLOCK {
+			r.removeBlock(action.ip.String(), action.untilMs)
+		}
+	}
+}
+
+// al parar: espera a runBlockActions, ejecuta los desbloqueos pendientes y elimina todos los bloqueos activos
+func (ss *SshGuard) stopResponder(now time.Time) {
+	r := ss.responder
+	<-r.stopped
+	for pending := true; pending; {
+		select {
+		case action := <-r.actions:
+			if action.action == BLOCK_ACTION_BLOCK {
+				//no se llego a aplicar
+				r.removeBlock(action.ip.String(), action.untilMs)
+			} else {
+				ss.applyBlockAction(action)
+			}
+		default:
+			pending = false
+		}
+	}
+	for _, action := range r.takeBlocks(now, true) {
+		ss.applyBlockAction(action)
+	}
+}
+
+func (ss *SshGuard) applyBlockAction(action *blockAction) {
+	event := ss.runBlockAction(action)
+	if action.action == BLOCK_ACTION_BLOCK && !event.success {
+		ss.responder.removeBlock(action.ip.String(), action.untilMs)
+	}
+	ss.addMetric(event)
+	if ss.StateFile != "" && !ss.offline() {
+		//los bloqueos tienen que estar en disco por si el agente se cae antes del siguiente intervalo
+		if err := ss.saveState(); err != nil {
+			ss.Log.Error(err)
+		}
+	}
+}
+
+// elimina el bloqueo de la tabla si sigue siendo el mismo (no se ha vuelto a bloquear la ip)
+func (r *responder) removeBlock(ip string, untilMs int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if block, found := r.blocks[ip]; found && block.untilMs == untilMs {
+		delete(r.blocks, ip)
+	}
+}
+
+// ejecuta (o solo registra en dryRun) el bloqueo o desbloqueo y devuelve el evento
+func (ss *SshGuard) runBlockAction(action *blockAction) *blockEvent {
+	r := ss.responder
+	dryRun := r.cfg.DryRun || ss.offline()
+	ip := action.ip
+	seconds := uint64(0)
+	if remainingMs := action.untilMs - action.tsMs; remainingMs > 0 {
+		seconds = uint64((remainingMs + 999) / 1000)
+	}
+	args := r.command(action.action, ip, action.reason, seconds)
+	event := &blockEvent{
+		action:  action.action,
+		ip:      ip.String(),
+		reason:  action.reason,
+		backend: r.cfg.Backend,
+		dryRun:  dryRun,
+		success: true,
+		untilMs: action.untilMs,
+		tsMs:    action.tsMs,
+	}
+	if action.expired && r.cfg.Backend == RESPONSE_NFTABLES {
+		//el timeout del elemento ya lo ha eliminado del set
+		ss.Log.Infof("fin del bloqueo de %s (timeout de nftables)", ip)
+		return event
+	}
+	if dryRun {
+		ss.Log.Infof("[dry-run] %s %s: %q", action.action, ip, args)
+		return event
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), responseCommandTimeout)
+	defer cancel()
+	if output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput(); err != nil {
+		event.success = false
+		event.err = fmt.Sprintf("%v: %s", err, strings.TrimSpace(string(output)))
+		ss.Log.Errorf("error en %s de %s (%q): %s", action.action, ip, args, event.err)
+		return event
+	}
+	ss.Log.Infof("%s de %s hasta %v", action.action, ip, time.UnixMilli(action.untilMs).Format(time.DateTime))
+	return event
+}
+
+// bloquea la ip de una alerta de fuerza bruta si no esta en la allowlist ni bloqueada ya
+func (ss *SshGuard) blockSource(rawIp, reason string, now time.Time) {
+	ip := net.ParseIP(rawIp)
+	if ip == nil {
+		return
+	}
+	r := ss.responder
+	if r.allowed(ip) {
+		ss.Log.Infof("no se bloquea %s: está en la allowlist", ip)
+		return
+	}
+	r.mutex.Lock()
+	if _, blocked := r.blocks[ip.String()]; blocked {
+		r.mutex.Unlock()
+		return
+	}
+	block := &activeBlock{reason: reason, sinceMs: now.UnixMilli(), untilMs: now.Add(time.Duration(r.cfg.BlockSeconds) * time.Second).UnixMilli()}
+	r.blocks[ip.String()] = block
+	r.mutex.Unlock()
+
+	ss.queueBlockAction(&blockAction{action: BLOCK_ACTION_BLOCK, ip: ip, reason: reason, untilMs: block.untilMs, tsMs: now.UnixMilli()})
+}
+
+// elimina los bloqueos expirados
+func (ss *SshGuard) expireBlocks(now time.Time) {
+	for _, action := range ss.responder.takeBlocks(now, false) {
+		ss.queueBlockAction(action)
+	}
+}
+
+// saca de la tabla los bloqueos expirados, o todos si all es true (parada del plugin), y devuelve sus desbloqueos
+func (r *responder) takeBlocks(now time.Time, all bool) []*blockAction {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var actions []*blockAction
+	for ip, block := range r.blocks {
+		expired := block.untilMs <= now.UnixMilli()
+		if all || expired {
+			actions = append(actions, &blockAction{action: BLOCK_ACTION_UNBLOCK, ip: net.ParseIP(ip), reason: block.reason, untilMs: block.untilMs, expired: expired, tsMs: now.UnixMilli()})
+			delete(r.blocks, ip)
+		}
+	}
+	return actions
+}
+
+func (be *blockEvent) TelegrafNormalize() system_utils.TelegrafEvent {
+	tags := map[string]string{
+		"group":     "SSH",
+		"eventType": string(SSH_BLOCK),
+		"action":    be.action,
+		"ip":        be.ip,
+		"backend":   be.backend,
+		"dryRun":    strconv.FormatBool(be.dryRun),
+	}
+	if be.reason != "" {
+		tags["reason"] = be.reason
+	}
+	fields := map[string]interface{}{
+		"success": be.success,
+		"expires": be.untilMs,
+	}
+	if be.err != "" {
+		fields["error"] = be.err
+	}
+	return system_utils.TelegrafEvent{
+		Fields:   fields,
+		Tags:     tags,
+		DeviceID: system_utils.GetUniqueID(),
+		Time:     time.UnixMilli(be.tsMs),
+	}
+}
@@ -0,0 +1,71 @@
+package ssh_guard
+
+import "time"
+
+var (
+	SSH_SESSION_IDLE    eventType = "session_idle"
+	SSH_SESSION_OVERDUE eventType = "session_overdue"
+)
+
+// por defecto algo mas que el LoginGraceTime de sshd (120s)
+var defaultPreauthTimeoutSeconds uint64 = 300
+
+// elimina las sesiones vistas solo en el trafico (sin login ni ninguna linea del log asociada) que llevan
+// preauthTimeoutSeconds sin trafico: escaneos y conexiones cuyas lineas no hacen match con ningun patron no tienen nada
+// que las cierre. Se cuenta desde el ultimo paquete para no cortar las sesiones activas cuando no se lee el log.
+// Debe llamarse con ss.mutex bloqueado
+func (ss *SshGuard) expirePreauthSession(sessionKey string, session *sshSession, now time.Time) {
+	if ss.PreauthTimeoutSeconds == 0 || session.authenticated || session.pid != "" {
+		return
+	}
+	if now.UnixMilli()-session.lastActivityMs < int64(ss.PreauthTimeoutSeconds)*1000 {
+		return
+	}
+	ss.Log.Infof("sesión %v sin login ni tráfico en %d segundos, se elimina", sessionKey, ss.PreauthTimeoutSeconds)
+	session.delete = true
+	session.logoutTsMs = session.lastActivityMs
+}
+
+// comprueba los umbrales de sesion inactiva y sesion demasiado larga. Cada evento se envia una vez por cruce del umbral:
+// el de inactividad se rearma cuando vuelve a haber trafico. Debe llamarse con ss.mutex bloqueado
+func (ss *SshGuard) checkSessionLimits(sessionKey string, session *sshSession, now time.Time) {
+	nowMs := now.UnixMilli()
+	if ss.IdleTimeoutMinutes > 0 && !session.idleNotified && nowMs-session.lastActivityMs >= int64(ss.IdleTimeoutMinutes)*60*1000 {
+		session.idleNotified = true
+		ss.Log.Infof("sesión %v inactiva desde %v", sessionKey, time.UnixMilli(session.lastActivityMs).Format(time.DateTime))
+		ss.addMetric(session.limitEvent(SSH_SESSION_IDLE, nowMs))
+	}
+	if ss.MaxSessionHours > 0 && !session.overdueNotified && nowMs-session.sessionStartMs() >= int64(ss.MaxSessionHours)*3600*1000 {
+		session.overdueNotified = true
+		ss.Log.Infof("sesión %v abierta desde %v", sessionKey, time.UnixMilli(session.sessionStartMs()).Format(time.DateTime))
+		ss.addMetric(session.limitEvent(SSH_SESSION_OVERDUE, nowMs))
+	}
+}
+
+// copia de la sesion para el evento, para no compartir la sesion en memoria con el acumulador
+func (s *sshSession) limitEvent(event eventType, tsMs int64) *sshSession {
+	limit := *s
+	limit.event = event
+	limit.tsMs = tsMs
+	return &limit
+}
+
+// inicio de la sesion: el login, o la primera vez que se vio si no hay login
+func (s *sshSession) sessionStartMs() int64 {
+	if s.loginTsMs != 0 {
+		return s.loginTsMs
+	}
+	return s.startTsMs
+}
+
+func (s *sshSession) addLimitFields(fields map[string]interface{}) {
+	if s.event == SSH_SESSION_IDLE {
+		fields["lastActivity"] = s.lastActivityMs
+		fields["idleSeconds"] = (s.tsMs - s.lastActivityMs) / 1000
+		return
+	}
+	if s.loginTsMs != 0 {
+		fields["loginTime"] = s.loginTsMs
+	}
+	fields["duration"] = (s.tsMs - s.sessionStartMs()) / 1000
+}
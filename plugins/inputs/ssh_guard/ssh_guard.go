@@ -1,15 +1,14 @@
 package ssh_guard
 
 import (
-	"bufio"
 	_ "embed"
 	"fmt"
-	"log"
+	"io"
 	"math"
 	"net"
-	"os"
-	"os/exec"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -28,55 +27,141 @@ var (
 	NEW_SSH_NEW_CONN             eventType = "conn"
 	NEW_SSH_LOGIN                eventType = "login"
 	NEW_SSH_FAILED_LOGIN_ATTEMPT eventType = "login_attempt_fail"
+	NEW_SSH_INVALID_USER         eventType = "invalid_user" //no cuenta como intento: sshd escribe despues un "Failed ... for invalid user"
 	NEW_SSH_FINAL_LOGIN_FAILED   eventType = "login_fail"
 	NEW_SSH_LOGOUT               eventType = "logout"
+	NEW_SSH_SESSION_OPENED       eventType = "session_open"
+	NEW_SSH_SESSION_CLOSED       eventType = "session_close"
 
 	SSH_SESSION_RX_BYTES eventType = "ssh_session_rx_bytes"
 	SSH_SESSION_TX_BYTES eventType = "ssh_session_tx_bytes"
+	SSH_SESSION_SUMMARY  eventType = "session_summary"
 )
 
 var (
 	MONITOR_SSH_LOGIN_BASE_TIME  time.Duration = time.Duration(20) * time.Millisecond
 	MONITOR_SSH_LOGIN_LIMIT_TIME time.Duration = time.Duration(5) * time.Second
+	//espera para reabrir la fuente de log tras un error
+	MONITOR_SSH_LOGIN_RETRY_BASE_TIME  time.Duration = time.Second
+	MONITOR_SSH_LOGIN_RETRY_LIMIT_TIME time.Duration = time.Minute
 )
 
 //go:embed sample.conf
 var sampleConfig string
 
 var defaultSshPort uint16 = 22
+var defaultIntervalRateSeconds uint64 = 10
 
-const auditLogPath string = "/var/log/auth.log"
 const auditLogTimeLayout string = "Jan 2 15:04:05 2006"
 
+// hora al principio de cada linea del log, formato clasico de syslog o ISO
+var reTime = regexp.MustCompile(`^((?:\w{3}\s+\d{1,2}\s+\d{2}:\d{2}:\d{2})|(?:\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:[+-]\d{2}:\d{2})?))`)
+
 // Estructura para estadísticas de cada sesión SSH
 type sshSession struct {
-	bytesSent uint64
-	bytesRecv uint64
-	user      string
-	ip        string
-	port      string
-	tsMs      int64
-	event     eventType
-	delete    bool //flag que se activa cuando la sesion esta lista para borrarse
+	bytesSent     uint64
+	bytesRecv     uint64
+	user          string
+	ip            string
+	port          string
+	tsMs          int64
+	event         eventType
+	delete        bool        //flag que se activa cuando la sesion esta lista para borrarse
+	authenticated bool        //login correcto (o sesion ya establecida al arrancar)
+	iface         string      //interfaz por la que se ha visto el trafico de la sesion
+	listenPort    *ListenPort //instancia de sshd que atiende la sesion
+	pid           string      //pid del proceso sshd/dropbear que escribe los eventos de la sesion en el log (monitor en OpenSSH)
+	tty           string      //terminal de la sesion (pts/0), obtenido del titulo del proceso sshd
+	//totales de toda la vida de la sesion (bytesSent/bytesRecv se resetean en cada intervalo)
+	startTsMs      int64 //primera vez que se ve la sesion
+	loginTsMs      int64
+	logoutTsMs     int64
+	totalBytesSent uint64
+	totalBytesRecv uint64
+	totalPackets   uint64
+	totalRetrans   uint64
+	//deteccion de sesiones inactivas y demasiado largas
+	lastActivityMs  int64 //ultimo paquete visto
+	idleNotified    bool
+	overdueNotified bool
+	//paquetes y retransmisiones del intervalo actual, en cada sentido
+	packetsSent     uint64
+	packetsRecv     uint64
+	retransSent     uint64
+	retransRecv     uint64
+	seqSent         tcpSeqTracker
+	seqRecv         tcpSeqTracker
+	intervalSeconds uint64 //duracion del intervalo para calcular bytesPerSecond
+	//datos de autenticacion del login (publickey, certificate, password, keyboard-interactive/pam...)
+	authMethod     string
+	keyType        string
+	keyFingerprint string
+	certKeyId      string
+	//lineas de identificacion SSH vistas en el trafico
+	clientVersion string
+	serverVersion string
 }
 
 type SshGuard struct {
-	InterfaceTracked    string `toml:"interfaceTracked"`
-	SshListenPort       uint16 `toml:"sshListenPort"`
-	IntervalRateSeconds uint64 `toml:"intervalRateSeconds"`
+	InterfaceTracked         string          `toml:"interfaceTracked"`  //deprecated: usar interfacesTracked
+	InterfacesTracked        []string        `toml:"interfacesTracked"` //interfaces donde capturar o "any" para todas
+	SshListenPort            uint16          `toml:"sshListenPort"`
+	ListenPorts              []*ListenPort   `toml:"listenPorts"` //varias instancias de sshd. Si se configura se ignora sshListenPort
+	IntervalRateSeconds      uint64          `toml:"intervalRateSeconds"`
+	LogSource                string          `toml:"logSource"`          //file o journald
+	LogPath                  string          `toml:"logPath"`            //solo para logSource = file
+	LogDialect               string          `toml:"logDialect"`         //auto, openssh o dropbear
+	JournalIdentifiers       []string        `toml:"journalIdentifiers"` //solo para logSource = journald (SYSLOG_IDENTIFIER)
+	LogRotateCatchUp         bool            `toml:"logRotateCatchUp"`   //recupera las lineas escritas en el fichero rotado antes de pasar al nuevo
+	LogRotatedPath           string          `toml:"logRotatedPath"`     //nombre del fichero rotado (copytruncate). Por defecto logPath + ".1"
+	Patterns                 []*EventPattern `toml:"patterns"`           //patrones de eventos añadidos o sobrescritos por el usuario
+	eventPatterns            []*EventPattern
+	Bruteforce               BruteforceConfig    `toml:"bruteforce"`
+	ProcRoot                 string              `toml:"procRoot"`                 //raiz de procfs para descubrir las sesiones activas al arrancar
+	TrackPrivilegeEscalation bool                `toml:"trackPrivilegeEscalation"` //eventos privilege_escalation de sudo y su
+	Zones                    []*Zone             `toml:"zones"`                    //redes de origen con nombre para el tag zone
+	AllowedZones             map[string][]string `toml:"allowedZones"`             //usuario => zonas desde las que puede hacer login ("*" para el resto)
+	IdleTimeoutMinutes       uint64              `toml:"idleTimeoutMinutes"`       //evento session_idle tras N minutos sin trafico. 0 desactivado
+	MaxSessionHours          uint64              `toml:"maxSessionHours"`          //evento session_overdue cuando la sesion supera M horas. 0 desactivado
+	PreauthTimeoutSeconds    uint64              `toml:"preauthTimeoutSeconds"`    //se eliminan las sesiones sin login ni lineas del log tras N segundos sin trafico. 0 desactivado
+	Response                 ResponseConfig      `toml:"response"`                 //respuesta activa: bloqueo de las ips con alertas de fuerza bruta
+	StateFile                string              `toml:"stateFile"`                //fichero donde se guarda la posicion del log y las sesiones entre reinicios. Vacio para desactivarlo
+	OfflinePcapFile          string              `toml:"offlinePcapFile"`          //modo offline: captura pcap/pcapng a reproducir en lugar de capturar en vivo
+	OfflineAuthLog           string              `toml:"offlineAuthLog"`           //modo offline: log de autenticacion grabado, se lee desde el principio
+	OfflineLocalIps          []string            `toml:"offlineLocalIps"`          //modo offline: ips del servidor en la captura. Si esta vacio se usa el puerto de sshd
+	OfflineYear              int                 `toml:"offlineYear"`              //modo offline: año de las lineas de syslog clasico. Por defecto el del primer paquete de la captura
+	offlineYear              int
+	bruteforce               *bruteforceDetector
+	zones                    *zoneClassifier
+	responder                *responder
 	//solo sshSessions de bytes enviados y recibidos. Los eventos de sesion no se almacenaran en memoria, sino que se enviara inmediatamente al producirse
-	sshSessions    map[string]*sshSession //key = ip:port
-	mutex          sync.Mutex
-	localIpInIface string
-	sshSnifer      *pcap.Handle
-	done           chan struct{}
-	Log            telegraf.Logger `toml:"-"`
-	accumulator    telegraf.Accumulator
+	sshSessions         map[string]*sshSession  //key = ip:port ([ip]:port en ipv6), clave de los contadores de paquetes
+	sessionPids         map[string]*sshSession  //pid del proceso que escribe en el log => sesion. Clave principal de los eventos del log
+	pendingConns        map[string]*pendingConn //eventos conn esperando al banner del cliente. key = key de sshSessions
+	logPosition         *logPosition            //posicion tras la ultima linea procesada, se guarda en stateFile
+	restoredLogPosition *logPosition            //posicion recuperada de stateFile al arrancar
+	savedState          []byte                  //ultimo estado escrito en stateFile (sin savedAtMs), para no reescribirlo si no cambia
+	stateMutex          sync.Mutex              //una sola escritura de stateFile a la vez (intervalo y Stop)
+	mutex               sync.Mutex
+	interfaces          []string //interfaces resueltas en las que se captura. Protegido por sniferMutex
+	trackAllInterfaces  bool     //"any": tambien se captura en las interfaces que se levantan despues de arrancar
+	listenPorts         []*ListenPort
+	localAddrs          *localAddrs
+	sshSnifers          []*pcap.Handle //una captura por interfaz
+	sniferMutex         sync.Mutex
+	done                chan struct{}
+	Log                 telegraf.Logger `toml:"-"`
+	accumulator         telegraf.Accumulator
 }
 
 func newSshSesion(user, ip, port string, event eventType, tsMs int64) *sshSession {
 	return &sshSession{tsMs: tsMs, user: user, ip: ip, port: port, event: event}
 }
+
+// crea una sesion para guardar en sshSessions
+func newTrackedSession(ip, port string, startTsMs int64) *sshSession {
+	return &sshSession{ip: ip, port: port, startTsMs: startTsMs, lastActivityMs: startTsMs}
+}
 func (s *sshSession) TelegrafNormalize() system_utils.TelegrafEvent {
 	fields := make(map[string]interface{})
 	tags := map[string]string{
@@ -90,10 +175,40 @@ func (s *sshSession) TelegrafNormalize() system_utils.TelegrafEvent {
 		s.user = "unknown"
 	}
 	tags["user"] = s.user
+	if s.listenPort != nil {
+		tags["sshInstance"] = s.listenPort.name()
+	}
+	if s.event == NEW_SSH_LOGIN || s.event == SSH_SESSION_SUMMARY {
+		s.addAuthTags(tags)
+	}
+	if s.event == NEW_SSH_NEW_CONN || s.event == SSH_SESSION_SUMMARY {
+		s.addVersionTags(tags)
+	}
+	if (s.event == SSH_SESSION_RX_BYTES || s.event == SSH_SESSION_TX_BYTES || s.event == SSH_SESSION_SUMMARY ||
+		s.event == SSH_SESSION_IDLE || s.event == SSH_SESSION_OVERDUE) && s.iface != "" {
+		tags["interface"] = s.iface
+	}
 	if s.event == SSH_SESSION_RX_BYTES {
-		fields["connbytes"] = s.bytesRecv
+		addTrafficFields(fields, s.bytesRecv, s.packetsRecv, s.retransRecv, s.intervalSeconds)
 	} else if s.event == SSH_SESSION_TX_BYTES {
-		fields["connbytes"] = s.bytesSent
+		addTrafficFields(fields, s.bytesSent, s.packetsSent, s.retransSent, s.intervalSeconds)
+	} else if s.event == SSH_SESSION_SUMMARY {
+		//la duracion se cuenta desde el login, o desde que se vio la sesion si no llego a hacer login
+		start := s.loginTsMs
+		if start == 0 {
+			start = s.startTsMs
+		}
+		if s.loginTsMs != 0 {
+			fields["loginTime"] = s.loginTsMs
+		}
+		fields["logoutTime"] = s.logoutTsMs
+		fields["duration"] = (s.logoutTsMs - start) / 1000
+		fields["bytesSent"] = s.totalBytesSent
+		fields["bytesRecv"] = s.totalBytesRecv
+		fields["packets"] = s.totalPackets
+		fields["retransmissions"] = s.totalRetrans
+	} else if s.event == SSH_SESSION_IDLE || s.event == SSH_SESSION_OVERDUE {
+		s.addLimitFields(fields)
 	} else {
 		fields["authevent"] = 1
 	}
@@ -105,22 +220,141 @@ func (s *sshSession) TelegrafNormalize() system_utils.TelegrafEvent {
 		Time:     time.UnixMilli(s.tsMs),
 	}
 }
+
+// copia en la sesion los datos de autenticacion del login
+func (s *sshSession) setAuthInfo(groups map[string]string) {
+	//dropbear: "Password"/"Pubkey" => mismos nombres que OpenSSH
+	s.authMethod = strings.ToLower(groups[GROUP_METHOD])
+	if s.authMethod == "pubkey" {
+		s.authMethod = "publickey"
+	}
+	s.keyType = groups[GROUP_KEY_TYPE]
+	s.keyFingerprint = groups[GROUP_FINGERPRINT]
+	s.certKeyId = groups[GROUP_KEY_ID]
+	if s.authMethod == "publickey" && (s.certKeyId != "" || strings.HasSuffix(s.keyType, "-CERT")) {
+		s.authMethod = "certificate"
+	}
+}
+func (s *sshSession) addAuthTags(tags map[string]string) {
+	if s.authMethod != "" {
+		tags["authMethod"] = s.authMethod
+	}
+	if s.keyType != "" {
+		tags["keyType"] = s.keyType
+	}
+	if s.keyFingerprint != "" {
+		tags["keyFingerprint"] = s.keyFingerprint
+	}
+	if s.certKeyId != "" {
+		tags["certKeyId"] = s.certKeyId
+	}
+}
 func (ss *SshGuard) SampleConfig() string {
 	return sampleConfig
 }
 func (ss *SshGuard) Init() error {
 	ss.Log.Info("ssh events monitor started")
-	ss.sshSessions = getActiveSSHSessions()
 	if ss.SshListenPort == 0 {
 		ss.SshListenPort = defaultSshPort
 	}
-	localIp, err := getIPFromInterface(ss.InterfaceTracked)
+	listenPorts, err := resolveListenPorts(ss.ListenPorts, ss.SshListenPort)
+	if err != nil {
+		return err
+	}
+	ss.listenPorts = listenPorts
+	if ss.IntervalRateSeconds == 0 {
+		ss.IntervalRateSeconds = defaultIntervalRateSeconds
+	}
+	if ss.ProcRoot == "" {
+		ss.ProcRoot = defaultProcRoot
+	}
+	switch ss.LogSource {
+	case "":
+		ss.LogSource = LOG_SOURCE_FILE
+	case LOG_SOURCE_FILE, LOG_SOURCE_JOURNALD:
+	default:
+		return fmt.Errorf("logSource %q no soportado. Valores posibles: %q, %q", ss.LogSource, LOG_SOURCE_FILE, LOG_SOURCE_JOURNALD)
+	}
+	if ss.LogPath == "" {
+		ss.LogPath = defaultAuditLogPath
+	}
+	switch ss.LogDialect {
+	case "":
+		ss.LogDialect = DIALECT_AUTO
+	case DIALECT_AUTO, DIALECT_OPENSSH, DIALECT_DROPBEAR:
+	default:
+		return fmt.Errorf("logDialect %q no soportado. Valores posibles: %q", ss.LogDialect, logDialects)
+	}
+	if len(ss.JournalIdentifiers) == 0 {
+		ss.JournalIdentifiers = defaultDialectIdentifiers(ss.LogDialect)
+	}
+	identifiers := ss.listenPortIdentifiers()
+	if ss.TrackPrivilegeEscalation {
+		identifiers = append(identifiers, privilegeJournalIdentifiers...)
+	}
+	for _, identifier := range identifiers {
+		if !slices.Contains(ss.JournalIdentifiers, identifier) {
+			ss.JournalIdentifiers = append(ss.JournalIdentifiers, identifier)
+		}
+	}
+	eventPatterns, err := mergeEventPatterns(defaultEventPatterns, ss.Patterns)
+	if err != nil {
+		return err
+	}
+	ss.eventPatterns = eventPatterns
+	if ss.Bruteforce.Enabled {
+		ss.bruteforce = newBruteforceDetector(ss.Bruteforce)
+	}
+	if ss.Response.Enabled {
+		if ss.bruteforce == nil {
+			return fmt.Errorf("response: la respuesta activa necesita la detección de fuerza bruta (bruteforce.enabled)")
+		}
+		if ss.responder, err = newResponder(ss.Response); err != nil {
+			return err
+		}
+		if ss.StateFile == "" && ss.Response.Backend != RESPONSE_NFTABLES && !ss.Response.DryRun {
+			ss.Log.Warnf("response: sin stateFile los bloqueos de %s no se eliminan si el agente se cae", ss.Response.Backend)
+		}
+	}
+	if len(ss.Zones) != 0 || len(ss.AllowedZones) != 0 {
+		if ss.zones, err = newZoneClassifier(ss.Zones, ss.AllowedZones); err != nil {
+			return err
+		}
+	}
+	ss.sessionPids = make(map[string]*sshSession)
+	ss.pendingConns = make(map[string]*pendingConn)
+	if ss.offline() {
+		return ss.initOffline()
+	}
+	ss.sshSessions = ss.getActiveSSHSessions()
+	for _, session := range ss.sshSessions {
+		if session.pid != "" {
+			ss.sessionPids[session.pid] = session
+		}
+	}
+	if ss.StateFile != "" {
+		ss.restoreState()
+	}
+	trackedNames := ss.InterfacesTracked
+	if ss.InterfaceTracked != "" {
+		trackedNames = append(trackedNames, ss.InterfaceTracked)
+	}
+	ss.trackAllInterfaces = slices.Contains(trackedNames, ANY_INTERFACE)
+	ss.interfaces, err = resolveTrackedInterfaces(trackedNames)
 	if err != nil {
 		ss.Log.Error(err)
 		return err
 	}
-	//TODO ahora mismo esta localIpSeria siempre la que se lee al principio. Que pasa si se cae la red y se asigna otra ip a la interface?
-	ss.localIpInIface = localIp
+	localIps, err := getIPsFromInterfaces(ss.interfaces)
+	if err != nil {
+		ss.Log.Error(err)
+		return err
+	}
+	if len(localIps) == 0 {
+		//puede que aun no tengan ip (DHCP), se actualizaran al llegar las notificaciones de rtnetlink
+		ss.Log.Warnf("las interfaces %v no tienen ninguna dirección IP asignada", ss.interfaces)
+	}
+	ss.localAddrs = newLocalAddrs(localIps)
 	for id, session := range ss.sshSessions {
 		ss.Log.Infof("sessionId: %v | ip: %v | port: %v | user: %v\n", id, session.ip, session.port, session.user)
 	}
@@ -129,20 +363,59 @@ func (ss *SshGuard) Init() error {
 func (ss *SshGuard) Start(acc telegraf.Accumulator) error {
 	ss.accumulator = acc
 	ss.done = make(chan struct{})
+	if ss.responder != nil {
+		go ss.runBlockActions()
+	}
+	if ss.offline() {
+		go ss.runOfflineReplay()
+		return nil
+	}
 	go ss.checkBytesStatistics()
+	go ss.checkPendingConns()
 	go ss.monitorSshLogin()
-	go ss.snifferSshTraffic()
+	go ss.watchInterfaceAddrs()
+	for _, iface := range ss.trackedInterfaces() {
+		go ss.snifferSshTraffic(iface)
+	}
+	if ss.trackAllInterfaces {
+		go ss.watchInterfaceLinks()
+	}
+	if ss.bruteforce != nil {
+		go ss.checkBruteforceAlerts()
+	}
 	ss.Log.Info("ssh sniffer started")
 	return nil
 }
+
+// informa del estado actual de las sesiones: activas, autenticadas/preauth y sesiones por usuario
 func (ss *SshGuard) Gather(acc telegraf.Accumulator) error {
+	if ss.offline() {
+		//en modo offline el estado es el de la reproduccion, no el del equipo
+		return nil
+	}
+	for _, metric := range ss.collectSessionGauges(time.Now()) {
+		telEvent := metric.TelegrafNormalize()
+		acc.AddFields(telEvent.GetDeviceID(), telEvent.GetFields(), telEvent.GetTags(), telEvent.GetTime())
+	}
 	return nil
 }
 
 func (ss *SshGuard) Stop() {
 	close(ss.done)
-	if ss.sshSnifer != nil {
-		ss.sshSnifer.Close()
+	ss.sniferMutex.Lock()
+	for _, handle := range ss.sshSnifers {
+		handle.Close()
+	}
+	ss.sshSnifers = nil
+	ss.sniferMutex.Unlock()
+	if ss.responder != nil {
+		//no se dejan bloqueos sin nadie que los elimine
+		ss.stopResponder(time.Now())
+	}
+	if ss.StateFile != "" && !ss.offline() {
+		if err := ss.saveState(); err != nil {
+			ss.Log.Error(err)
+		}
 	}
 }
 func (ss *SshGuard) checkBytesStatistics() {
@@ -154,197 +427,160 @@ func (ss *SshGuard) checkBytesStatistics() {
 			return
 		case <-ticker.C:
 		}
-		ss.Log.Info("\n---- Estadísticas de sesiones SSH ----")
-		now := time.Now()
-		ss.mutex.Lock()
-		for session, stats := range ss.sshSessions {
-			var rxMetric, txMetric system_utils.SystemMetric
-			if stats.bytesRecv == 0 && stats.bytesSent == 0 {
-				if stats.delete {
-					delete(ss.sshSessions, fmt.Sprintf("%v:%v", stats.ip, stats.port))
-				}
-				continue
-			}
-			rxMetric = &sshSession{
-				ip:        stats.ip,
-				port:      stats.port,
-				user:      stats.user,
-				tsMs:      now.UnixMilli(),
-				bytesRecv: stats.bytesRecv,
-				event:     SSH_SESSION_RX_BYTES,
-			}
-			txMetric = &sshSession{
-				ip:        stats.ip,
-				port:      stats.port,
-				user:      stats.user,
-				tsMs:      now.UnixMilli(),
-				bytesSent: stats.bytesSent,
-				event:     SSH_SESSION_TX_BYTES,
+		ss.flushBytesStatistics(time.Now())
+		if ss.StateFile != "" {
+			if err := ss.saveState(); err != nil {
+				ss.Log.Error(err)
 			}
-			me_rx := rxMetric.TelegrafNormalize()
-			me_tx := txMetric.TelegrafNormalize()
-			ss.accumulator.AddFields(me_rx.DeviceID, me_rx.Fields, me_rx.Tags, me_rx.GetTime())
-			ss.accumulator.AddFields(me_tx.DeviceID, me_tx.Fields, me_tx.Tags, me_tx.GetTime())
-			ss.Log.Infof("Sesión %v -> Bytes Recibidos: %v | Bytes Enviados: %v\n", session, formatLogBytes(stats.bytesRecv), formatLogBytes(stats.bytesSent))
+		}
+	}
+}
+
+// envia los bytes de cada sesion acumulados en el intervalo y elimina las sesiones finalizadas
+func (ss *SshGuard) flushBytesStatistics(now time.Time) {
+	ss.Log.Info("\n---- Estadísticas de sesiones SSH ----")
+	ss.mutex.Lock()
+	for session, stats := range ss.sshSessions {
+		var rxMetric, txMetric system_utils.SystemMetric
+		if !stats.delete {
+			ss.expirePreauthSession(session, stats, now)
+		}
+		if !stats.delete {
+			ss.checkSessionLimits(session, stats, now)
+		}
+		if stats.bytesRecv == 0 && stats.bytesSent == 0 {
 			if stats.delete {
-				delete(ss.sshSessions, fmt.Sprintf("%v:%v", stats.ip, stats.port))
-				continue
+				ss.removeSession(session, stats, now)
 			}
-			stats.bytesRecv = 0
-			stats.bytesSent = 0
+			continue
 		}
-		ss.mutex.Unlock()
-		ss.Log.Info("--------------------------------------")
+		rxMetric = &sshSession{
+			ip:              stats.ip,
+			port:            stats.port,
+			user:            stats.user,
+			iface:           stats.iface,
+			listenPort:      stats.listenPort,
+			tsMs:            now.UnixMilli(),
+			bytesRecv:       stats.bytesRecv,
+			packetsRecv:     stats.packetsRecv,
+			retransRecv:     stats.retransRecv,
+			intervalSeconds: ss.IntervalRateSeconds,
+			event:           SSH_SESSION_RX_BYTES,
+		}
+		txMetric = &sshSession{
+			ip:              stats.ip,
+			port:            stats.port,
+			user:            stats.user,
+			iface:           stats.iface,
+			listenPort:      stats.listenPort,
+			tsMs:            now.UnixMilli(),
+			bytesSent:       stats.bytesSent,
+			packetsSent:     stats.packetsSent,
+			retransSent:     stats.retransSent,
+			intervalSeconds: ss.IntervalRateSeconds,
+			event:           SSH_SESSION_TX_BYTES,
+		}
+		ss.addMetric(rxMetric)
+		ss.addMetric(txMetric)
+		ss.Log.Infof("Sesión %v -> Bytes Recibidos: %v (%d paquetes, %d retransmisiones) | Bytes Enviados: %v (%d paquetes, %d retransmisiones)\n", session,
+			formatLogBytes(stats.bytesRecv), stats.packetsRecv, stats.retransRecv, formatLogBytes(stats.bytesSent), stats.packetsSent, stats.retransSent)
+		if stats.delete {
+			ss.removeSession(session, stats, now)
+			continue
+		}
+		stats.bytesRecv = 0
+		stats.bytesSent = 0
+		stats.packetsRecv = 0
+		stats.packetsSent = 0
+		stats.retransRecv = 0
+		stats.retransSent = 0
 	}
+	ss.mutex.Unlock()
+	ss.Log.Info("--------------------------------------")
 }
-func (ss *SshGuard) monitorSshLogin() {
-	// now := time.Now()
-	file, err := os.Open(auditLogPath)
-	if err != nil {
-		ss.Log.Errorf("Error abriendo log %s: %v", auditLogPath, err)
-		return
-	}
-	defer file.Close()
 
-	reader := bufio.NewReader(file)
-	file.Seek(0, 2) // Ir al final del archivo
+// elimina la sesion de sshSessions y envia su resumen. Se debe llamar con ss.mutex bloqueado
+func (ss *SshGuard) removeSession(sessionKey string, session *sshSession, now time.Time) {
+	if ss.sshSessions[sessionKey] == session {
+		delete(ss.sshSessions, sessionKey)
+	}
+	//la sesion puede tener varios pids: el monitor y el proceso de la sesion en OpenSSH
+	for pid, pidSession := range ss.sessionPids {
+		if pidSession == session {
+			delete(ss.sessionPids, pid)
+		}
+	}
+	summary := *session
+	summary.event = SSH_SESSION_SUMMARY
+	if summary.logoutTsMs == 0 {
+		summary.logoutTsMs = now.UnixMilli()
+	}
+	summary.tsMs = summary.logoutTsMs
+	ss.Log.Infof("Fin de sesión %v -> Usuario: %v | Total Recibidos: %v | Total Enviados: %v | Paquetes: %v\n", sessionKey, session.user, formatLogBytes(session.totalBytesRecv), formatLogBytes(session.totalBytesSent), session.totalPackets)
+	ss.addMetric(&summary)
+}
 
-	// Expresiones regulares para capturar eventos
-	reConnection := regexp.MustCompile(`Connection from (\d+\.\d+\.\d+\.\d+) port (\d+) on (\d+\.\d+\.\d+\.\d+) port (\d+)`)
-	reFailedLogin := regexp.MustCompile(`Failed (password|none) for (invalid user )?(\S+) from (\d+\.\d+\.\d+\.\d+) port (\d+)`)
-	reSuccessfulLogin := regexp.MustCompile(`Accepted password for (\S+) from (\d+\.\d+\.\d+\.\d+) port (\d+)`)
-	//desconexion para todos los casos menos para cierre abrupto cliente ¿terminus?
-	reDisconnected := regexp.MustCompile(`Disconnected from user (\S+) (\d+\.\d+\.\d+\.\d+) port (\d+)`)
-	reClosed := regexp.MustCompile(`Connection closed by (\d+\.\d+\.\d+\.\d+) port (\d+)`)
-	reFinalFailedLogin := regexp.MustCompile(`Connection closed by authenticating user (\S+) (\d+\.\d+\.\d+\.\d+) port (\d+) \[preauth\]`)
-	// Caso: "error: maximum authentication attempts exceeded ... [preauth]" => fallo definitivo
-	reMaxAuthExceeded := regexp.MustCompile(`error: maximum authentication attempts exceeded for (?:invalid user )?(\S+) from (\d+\.\d+\.\d+\.\d+) port (\d+)(?:\s+ssh2)? \[preauth\]`)
-	reTime := regexp.MustCompile(`^((?:\w{3}\s+\d{1,2}\s+\d{2}:\d{2}:\d{2})|(?:\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:\+\d{2}:\d{2})?))`)
+// lee la fuente de log hasta que se para el plugin. Si la fuente falla (journalctl finalizado, error de lectura...)
+// se reabre desde la ultima posicion leida, esperando cada vez el doble hasta MONITOR_SSH_LOGIN_RETRY_LIMIT_TIME
+func (ss *SshGuard) monitorSshLogin() {
+	position := ss.restoredLogPosition
+	retryDelay := MONITOR_SSH_LOGIN_RETRY_BASE_TIME
+	for {
+		reader, err := ss.openAuthLog(position)
+		if err != nil {
+			ss.Log.Errorf("Error abriendo fuente de log %s: %v. Reintentando en %v", ss.LogSource, err, retryDelay)
+		} else {
+			ss.Log.Infof("Monitorizando accesos SSH (fuente: %s)...", ss.LogSource)
+			linesRead, err := ss.readAuthLog(reader)
+			lastPosition := reader.Position()
+			position = &lastPosition
+			reader.Close()
+			if err == nil {
+				return
+			}
+			if linesRead {
+				retryDelay = MONITOR_SSH_LOGIN_RETRY_BASE_TIME
+			}
+			ss.Log.Errorf("Error leyendo fuente de log %s: %v. Reabriendo en %v", ss.LogSource, err, retryDelay)
+		}
+		select {
+		case <-ss.done:
+			return
+		case <-time.After(retryDelay):
+		}
+		retryDelay = min(retryDelay*2, MONITOR_SSH_LOGIN_RETRY_LIMIT_TIME)
+	}
+}
 
-	ss.Log.Info("Monitorizando accesos SSH...")
+// procesa las lineas de la fuente de log. Devuelve nil cuando se para el plugin, o el error de lectura,
+// y si se ha llegado a leer alguna linea
+func (ss *SshGuard) readAuthLog(reader authLogReader) (linesRead bool, err error) {
 	noEventCount := 0
 
 	for {
 		select {
 		case <-ss.done:
-			return
+			return linesRead, nil
 		default:
 		}
-		line, err := reader.ReadString('\n')
-		// log.Println("Tiempo: ", time.Since(now))
-		// now = time.Now()
+		line, err := reader.ReadLine()
 		if err == nil {
 			noEventCount = 0
-			var newMetric system_utils.SystemMetric
-			matches := reTime.FindStringSubmatch(line)
-			if len(matches) >= 2 {
-				logTime := matches[1] // Hora extraída, por ejemplo "Feb 13 14:55:12"
-				tsMs := getTsFromAuditLog(logTime)
-
-				// Detección de conexión SSH (antes del login)
-				if matches := reConnection.FindStringSubmatch(line); len(matches) == 5 {
-					ip := matches[1]
-					port := matches[2]
-					newMetric = newSshSesion("", ip, port, NEW_SSH_NEW_CONN, tsMs)
-					ss.Log.Infof("[%s] Nueva conexión SSH establecida: Cliente='%s:%s' \n", logTime, ip, port)
-				} else if matches := reFailedLogin.FindStringSubmatch(line); len(matches) == 6 {
-					user := matches[3]
-					ip := matches[4]
-					port := matches[5]
-					newMetric = newSshSesion(user, ip, port, NEW_SSH_FAILED_LOGIN_ATTEMPT, tsMs)
-					sessionKey := fmt.Sprintf("%v:%v", ip, port)
-					ss.mutex.Lock()
-					if session, exists := ss.sshSessions[sessionKey]; exists {
-						session.user = user
-					} else {
-						ss.sshSessions[sessionKey] = &sshSession{
-							ip:   strings.Split(sessionKey, ":")[0],
-							port: strings.Split(sessionKey, ":")[1],
-							user: user,
-						}
-					}
-					ss.mutex.Unlock()
-					//asignar usuario
-					ss.Log.Infof("[%v] Intento fallido de login: Usuario='%s' IP='%s' Puerto='%s'\n", logTime, user, ip, port)
-				} else if matches := reFinalFailedLogin.FindStringSubmatch(line); len(matches) == 4 {
-					user := matches[1]
-					ip := matches[2]
-					port := matches[3]
-					newMetric = newSshSesion(user, ip, port, NEW_SSH_FINAL_LOGIN_FAILED, tsMs)
-					sessionKey := fmt.Sprintf("%v:%v", ip, port)
-					ss.mutex.Lock()
-					if session, exists := ss.sshSessions[sessionKey]; exists {
-						session.delete = true
-					}
-					ss.mutex.Unlock()
-					//proponer eliminar usuario
-					ss.Log.Infof("[%s] Login fallido definitivo: Usuario='%s' IP='%s' Puerto='%s' (Conexión cerrada)\n", logTime, user, ip, port)
-				} else if matches := reMaxAuthExceeded.FindStringSubmatch(line); len(matches) == 4 {
-					user := matches[1]
-					ip := matches[2]
-					port := matches[3]
-					newMetric = newSshSesion(user, ip, port, NEW_SSH_FINAL_LOGIN_FAILED, tsMs)
-					sessionKey := fmt.Sprintf("%v:%v", ip, port)
-					ss.mutex.Lock()
-					if session, exists := ss.sshSessions[sessionKey]; exists {
-						session.delete = true
-					}
-					ss.mutex.Unlock()
-					ss.Log.Infof("[%s] Login fallido definitivo: Usuario='%s' IP='%s' Puerto='%s' (Máximo de intentos excedido)\n", logTime, user, ip, port)
-				} else if matches := reSuccessfulLogin.FindStringSubmatch(line); len(matches) == 4 {
-					user := matches[1]
-					ip := matches[2]
-					port := matches[3]
-					newMetric = newSshSesion(user, ip, port, NEW_SSH_LOGIN, tsMs)
-					ss.mutex.Lock()
-					sessionKey := fmt.Sprintf("%v:%v", ip, port)
-					if session, exists := ss.sshSessions[sessionKey]; exists {
-						session.user = user
-					}
-					ss.mutex.Unlock()
-					//asignar usuario
-					ss.Log.Infof("[+] Inicio de sesión SSH exitoso: Usuario='%s' IP='%s' Puerto='%s'\n", user, ip, port)
-				} else if matches := reDisconnected.FindStringSubmatch(line); len(matches) == 4 {
-					user := matches[1]
-					ip := matches[2]
-					port := matches[3]
-					newMetric = newSshSesion(user, ip, port, NEW_SSH_LOGOUT, tsMs)
-					sessionKey := fmt.Sprintf("%v:%v", ip, port)
-					ss.mutex.Lock()
-					if session, exists := ss.sshSessions[sessionKey]; exists {
-						session.delete = true
-					}
-					ss.mutex.Unlock()
-					//proponer eliminar usuario. Lo hacemos asi para no eliminar un usuario aqui y luego no mandar el trafico en el ultimo tramo
-					ss.Log.Infof("[-] Usuario desconectado: Usuario='%s' IP='%s' Puerto='%s'\n", user, ip, port)
-				} else if matches := reClosed.FindStringSubmatch(line); len(matches) == 3 {
-					//esta caso es una desconexion pero sin saber el user. Asi que lo sacamos del mapa
-					ip := matches[1]
-					port := matches[2]
-					var user string
-					sessionKey := fmt.Sprintf("%v:%v", ip, port)
-					ss.mutex.Lock()
-					if session, exists := ss.sshSessions[sessionKey]; exists {
-						session.delete = true
-						//se obtiene en este caso el user del mapa en memoria ya que no viene en el match
-						user = session.user
-					}
-					ss.mutex.Unlock()
-					newMetric = newSshSesion(user, ip, port, NEW_SSH_LOGOUT, tsMs)
-					ss.Log.Infof("[--] Usuario desconectado: Usuario='%s' IP='%s' Puerto='%s'\n", user, ip, port)
-				}
-				if newMetric != nil {
-					telEvent := newMetric.TelegrafNormalize()
-					ss.accumulator.AddFields(telEvent.GetDeviceID(), telEvent.GetFields(), telEvent.GetTags(), telEvent.GetTime())
-				}
+			linesRead = true
+			ss.processAuthLine(line)
+			if ss.StateFile != "" {
+				ss.setLogPosition(reader.Position())
 			}
 			select {
 			case <-ss.done:
-				return
+				return linesRead, nil
 			case <-time.After(MONITOR_SSH_LOGIN_BASE_TIME):
 			}
 			continue
 		}
+		if err != io.EOF {
+			return linesRead, err
+		}
 		noEventCount++
 		factor := 5.0 // Ajusta este valor para cambiar la velocidad de crecimiento
 		delayFloat := float64(MONITOR_SSH_LOGIN_BASE_TIME) * math.Log1p(float64(noEventCount)*factor)
@@ -356,93 +592,364 @@ func (ss *SshGuard) monitorSshLogin() {
 		}
 		select {
 		case <-ss.done:
-			return
+			return linesRead, nil
 		case <-time.After(time.Duration(delayFloat)):
 		}
 	}
+}
 
+// procesa una linea del log de autenticacion: aplica los patrones de eventos, actualiza las sesiones en memoria y envia la metrica
+func (ss *SshGuard) processAuthLine(line string) {
+	tsMs, found := ss.lineTimestamp(line)
+	if !found {
+		return
+	}
+	if ss.TrackPrivilegeEscalation && ss.processPrivilegeLine(line, tsMs) {
+		return
+	}
+
+	match := matchEventPatterns(ss.eventPatterns, lineDialect(ss.LogDialect, line), line)
+	if match == nil {
+		return
+	}
+	user := match.groups[GROUP_USER]
+	ip := match.groups[GROUP_IP]
+	port := match.groups[GROUP_PORT]
+	_, pid := parseLogProgram(line)
+
+	ss.mutex.Lock()
+	session := ss.findLogSession(pid, ip, port, match.event, tsMs)
+	if session == nil && ip == "" {
+		ss.mutex.Unlock()
+		ss.Log.Debugf("evento %s (%s) sin sesión conocida para el pid %q", match.event, match.pattern.Name, pid)
+		return
+	}
+	exists := session != nil
+	if exists && ip == "" {
+		//linea sin direccion: la de la sesion del pid
+		ip, port = session.ip, session.port
+	}
+	sessionKey := net.JoinHostPort(ip, port)
+	listenPort := ss.listenPortForLine(line, match.groups, session)
+	if exists && session.listenPort == nil {
+		session.listenPort = listenPort
+	}
+	switch match.event {
+	case NEW_SSH_NEW_CONN:
+		//la sesion se crea aqui para asociar el pid desde la primera linea
+		if !exists {
+			session = newTrackedSession(ip, port, tsMs)
+			session.listenPort = listenPort
+			ss.sshSessions[sessionKey] = session
+		}
+	case NEW_SSH_FAILED_LOGIN_ATTEMPT, NEW_SSH_INVALID_USER:
+		//asignar usuario
+		if !exists {
+			session = newTrackedSession(ip, port, tsMs)
+			session.listenPort = listenPort
+			ss.sshSessions[sessionKey] = session
+		}
+		session.user = user
+	case NEW_SSH_LOGIN:
+		//asignar usuario y metodo de autenticacion
+		if !exists {
+			session = newTrackedSession(ip, port, tsMs)
+			session.listenPort = listenPort
+			ss.sshSessions[sessionKey] = session
+		}
+		session.user = user
+		session.loginTsMs = tsMs
+		session.authenticated = true
+		session.setAuthInfo(match.groups)
+	case NEW_SSH_SESSION_OPENED:
+		//pam abre la sesion tras un login correcto. Solo llega por pid
+		if exists {
+			if session.user == "" {
+				session.user = user
+			}
+			session.authenticated = true
+		}
+	case NEW_SSH_FINAL_LOGIN_FAILED, NEW_SSH_LOGOUT, NEW_SSH_SESSION_CLOSED:
+		//proponer eliminar usuario. Lo hacemos asi para no eliminar un usuario aqui y luego no mandar el trafico en el ultimo tramo
+		if exists {
+			session.delete = true
+			if session.logoutTsMs == 0 {
+				session.logoutTsMs = tsMs
+			}
+			//si el user no viene en el match se obtiene del mapa en memoria
+			if user == "" {
+				user = session.user
+			}
+		}
+	}
+	if session != nil && pid != "" {
+		if session.pid == "" {
+			session.pid = pid
+		}
+		ss.sessionPids[pid] = session
+	}
+	ss.mutex.Unlock()
+
+	ss.Log.Infof("[%s] Evento SSH %s (%s): Usuario='%s' IP='%s' Puerto='%s'\n", time.UnixMilli(tsMs).Format(time.DateTime), match.event, match.pattern.Name, user, ip, port)
+	eventSession := newSshSesion(user, ip, port, match.event, tsMs)
+	eventSession.listenPort = listenPort
+	if match.event == NEW_SSH_LOGIN {
+		eventSession.setAuthInfo(match.groups)
+		ss.Log.Infof("login con método: %s | clave: %s %s | key ID: %s", eventSession.authMethod, eventSession.keyType, eventSession.keyFingerprint, eventSession.certKeyId)
+	}
+	//el evento conn anterior de la sesion sale siempre antes que los siguientes
+	ss.flushPendingConn(sessionKey)
+	if match.event == NEW_SSH_NEW_CONN && ss.deferConnEvent(sessionKey, eventSession) {
+		return
+	}
+	ss.addMetric(eventSession)
+	if match.event == NEW_SSH_LOGIN && ss.zones != nil {
+		ss.checkLoginZone(eventSession)
+	}
+
+	if match.event == NEW_SSH_FAILED_LOGIN_ATTEMPT && ss.bruteforce != nil {
+		for _, alert := range ss.bruteforce.addFailure(ip, user, tsMs) {
+			ss.Log.Warnf("alerta de fuerza bruta: %v", alert.TelegrafNormalize().Tags)
+			ss.addMetric(alert)
+			if bfAlert, ok := alert.(*bruteforceAlert); ok && ss.responder != nil && bfAlert.scope == BRUTEFORCE_SCOPE_IP {
+				ss.blockSource(bfAlert.key, "bruteforce_"+bfAlert.reason, time.UnixMilli(bfAlert.tsMs))
+			}
+		}
+	}
+}
+
+// busca la sesion de una linea del log. Si la linea trae ip:port manda su direccion: si la sesion del pid tiene otra
+// (pid reutilizado, p.ej. tras reiniciar el equipo) se termina, y si el ip:port es el de una sesion de otro pid en una
+// conexion nueva (puerto reutilizado, clientes tras NAT) se termina la sesion anterior. El pid solo decide la sesion de
+// las lineas sin direccion (apertura y cierre de la sesion de pam, "Exit (user):" de dropbear).
+// Devuelve nil si no hay sesion. Debe llamarse con ss.mutex bloqueado
+func (ss *SshGuard) findLogSession(pid, ip, port string, event eventType, tsMs int64) *sshSession {
+	if session, found := ss.sessionPids[pid]; found && pid != "" {
+		if ip == "" {
+			return session
+		}
+		pidKey := net.JoinHostPort(session.ip, session.port)
+		if net.JoinHostPort(ip, port) == pidKey {
+			if !(event == NEW_SSH_NEW_CONN && session.delete) {
+				return session
+			}
+		} else if session.delete {
+			//la sesion ya termino, solo queda el pid
+			delete(ss.sessionPids, pid)
+		} else {
+			ss.Log.Infof("evento %s de %v del pid %s: se cierra la sesión anterior %v del mismo pid", event, net.JoinHostPort(ip, port), pid, pidKey)
+			if session.logoutTsMs == 0 {
+				session.logoutTsMs = tsMs
+			}
+			ss.removeSession(pidKey, session, time.UnixMilli(tsMs))
+		}
+	}
+	if ip == "" {
+		return nil
+	}
+	sessionKey := net.JoinHostPort(ip, port)
+	session, found := ss.sshSessions[sessionKey]
+	if !found {
+		return nil
+	}
+	if event == NEW_SSH_NEW_CONN && pid != "" && session.pid != "" && session.pid != pid {
+		ss.Log.Infof("conexión nueva %v del pid %s: se cierra la sesión anterior del pid %s", sessionKey, pid, session.pid)
+		if session.logoutTsMs == 0 {
+			session.logoutTsMs = tsMs
+		}
+		ss.removeSession(sessionKey, session, time.UnixMilli(tsMs))
+		return nil
+	}
+	return session
 }
-func (ss *SshGuard) snifferSshTraffic() {
-	// monitorSSHTraffic captura paquetes SSH y actualiza estadísticas
-	handle, err := pcap.OpenLive(ss.InterfaceTracked, 1600, true, 0, true)
+
+// normaliza la metrica y la envia al acumulador. Si hay zonas configuradas se añade la zona de la ip
+func (ss *SshGuard) addMetric(metric system_utils.SystemMetric) {
+	telEvent := metric.TelegrafNormalize()
+	if ip, found := telEvent.Tags["ip"]; found && ss.zones != nil {
+		telEvent.Tags["zone"] = ss.zones.classify(ip)
+	}
+	ss.accumulator.AddFields(telEvent.GetDeviceID(), telEvent.GetFields(), telEvent.GetTags(), telEvent.GetTime())
+}
+func (ss *SshGuard) snifferSshTraffic(iface string) {
+	// monitorSSHTraffic captura paquetes SSH de la interfaz y actualiza estadísticas
+	handle, err := pcap.OpenLive(iface, 1600, true, 0, true)
 	if err != nil {
-		ss.Log.Errorf("Error al abrir la interfaz %s: %v", ss.InterfaceTracked, err)
+		ss.Log.Errorf("Error al abrir la interfaz %s: %v", iface, err)
+		if ss.trackAllInterfaces {
+			ss.removeTrackedInterface(iface, nil)
+		}
 		return
 	}
-	ss.sshSnifer = handle
+	ss.sniferMutex.Lock()
+	select {
+	case <-ss.done:
+		//el plugin se ha parado mientras se abria la captura
+		ss.sniferMutex.Unlock()
+		handle.Close()
+		return
+	default:
+	}
+	ss.sshSnifers = append(ss.sshSnifers, handle)
+	ss.sniferMutex.Unlock()
 
-	// Filtrar tráfico en el puerto 22
-	if err := handle.SetBPFFilter(fmt.Sprintf("tcp port %d", ss.SshListenPort)); err != nil {
-		ss.Log.Errorf("Error al establecer filtro BPF en puerto %d: %v", ss.SshListenPort, err)
+	// Filtrar tráfico en los puertos de sshd
+	bpfFilter := buildBpfFilter(ss.listenPorts)
+	if err := handle.SetBPFFilter(bpfFilter); err != nil {
+		ss.Log.Errorf("Error al establecer filtro BPF %q: %v", bpfFilter, err)
 		handle.Close()
 		return
 	}
 
-	ss.Log.Infof("Monitorizando tráfico SSH en %s (actualización cada %d seg)...\n", ss.InterfaceTracked, ss.IntervalRateSeconds)
+	ss.Log.Infof("Monitorizando tráfico SSH en %s (actualización cada %d seg)...\n", iface, ss.IntervalRateSeconds)
 
 	packetSource := gopacket.NewPacketSource(handle, layers.LinkType(handle.LinkType()))
 
 	for packet := range packetSource.Packets() {
-		networkLayer := packet.NetworkLayer()
-		transportLayer := packet.TransportLayer()
+		ss.processPacket(packet, iface)
+	}
+	if ss.trackAllInterfaces {
+		//la interfaz ha desaparecido: se volvera a capturar si reaparece
+		ss.Log.Infof("fin de la captura en %s", iface)
+		ss.removeTrackedInterface(iface, handle)
+	}
+}
 
-		if networkLayer == nil || transportLayer == nil {
-			continue
-		}
+// contabiliza el paquete en la sesion ssh a la que pertenece
+func (ss *SshGuard) processPacket(packet gopacket.Packet, iface string) {
+	networkLayer := packet.NetworkLayer()
+	transportLayer := packet.TransportLayer()
 
-		// Extraer direcciones IP y puertos
-		ip, _ := networkLayer.(*layers.IPv4)
-		tcp, _ := transportLayer.(*layers.TCP)
-		if ip == nil || tcp == nil {
-			if ip == nil {
-				ss.Log.Warn("ip is nil")
-			}
-			if tcp == nil {
-				ss.Log.Warn("tcp is nil")
-			}
-			continue
-		}
+	if networkLayer == nil || transportLayer == nil {
+		return
+	}
 
-		sessionKey := ss.getKeyMap(ip, tcp)
-		if sessionKey == "" {
-			continue
+	// Extraer direcciones IP (v4 o v6) y puertos
+	srcIP, dstIP := getNetworkEndpoints(networkLayer)
+	tcp, _ := transportLayer.(*layers.TCP)
+	if srcIP == nil || tcp == nil {
+		if srcIP == nil {
+			ss.Log.Warn("ip is nil")
 		}
-
-		ss.mutex.Lock()
-		if _, exists := ss.sshSessions[sessionKey]; !exists {
-			ss.sshSessions[sessionKey] = &sshSession{
-				ip:   strings.Split(sessionKey, ":")[0],
-				port: strings.Split(sessionKey, ":")[1],
-			}
+		if tcp == nil {
+			ss.Log.Warn("tcp is nil")
 		}
+		return
+	}
 
-		packetSize := uint64(packet.Metadata().CaptureLength)
+	sessionKey := ss.getKeyMap(srcIP, dstIP, tcp)
+	if sessionKey == "" {
+		return
+	}
 
-		// Determinar si el tráfico es de entrada o salida
-		if tcp.SrcPort == layers.TCPPort(ss.SshListenPort) {
-			ss.sshSessions[sessionKey].bytesSent += packetSize
-		} else if tcp.DstPort == layers.TCPPort(ss.SshListenPort) {
-			ss.sshSessions[sessionKey].bytesRecv += packetSize
-		} else {
-			ss.Log.Infof("unknown traffic from: src: %v:%v | dst: %v:%v \n", ip.SrcIP.String(), tcp.SrcPort.String(), ip.DstIP.String(), tcp.DstPort.String())
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if _, exists := ss.sshSessions[sessionKey]; !exists {
+		if tcp.FIN || tcp.RST {
+			//ultimos paquetes de una conexion ya eliminada: no se crea otra sesion
+			return
 		}
-		ss.mutex.Unlock()
+		ip, port, _ := net.SplitHostPort(sessionKey)
+		ss.sshSessions[sessionKey] = newTrackedSession(ip, port, packet.Metadata().Timestamp.UnixMilli())
 	}
+	ss.sshSessions[sessionKey].iface = iface
 
+	//longitud real en el cable, no lo capturado (snaplen): las tramas jumbo/GSO superan el snaplen
+	packetSize := uint64(packet.Metadata().Length)
+	if packetSize == 0 {
+		packetSize = uint64(packet.Metadata().CaptureLength)
+	}
+
+	// Determinar si el tráfico es de entrada o salida
+	session := ss.sshSessions[sessionKey]
+	session.lastActivityMs = packet.Metadata().Timestamp.UnixMilli()
+	session.idleNotified = false
+	if lp := ss.listenPortByNumber(uint16(tcp.SrcPort)); lp != nil {
+		session.listenPort = lp
+		session.bytesSent += packetSize
+		session.totalBytesSent += packetSize
+		session.packetsSent++
+		session.totalPackets++
+		if session.seqSent.isRetransmission(tcp) {
+			session.retransSent++
+			session.totalRetrans++
+		}
+	} else if lp := ss.listenPortByNumber(uint16(tcp.DstPort)); lp != nil {
+		session.listenPort = lp
+		session.bytesRecv += packetSize
+		session.totalBytesRecv += packetSize
+		session.packetsRecv++
+		session.totalPackets++
+		if session.seqRecv.isRetransmission(tcp) {
+			session.retransRecv++
+			session.totalRetrans++
+		}
+	} else {
+		ss.Log.Infof("unknown traffic from: src: %v | dst: %v \n", net.JoinHostPort(srcIP.String(), tcp.SrcPort.String()), net.JoinHostPort(dstIP.String(), tcp.DstPort.String()))
+		return
+	}
+	//conexion tcp cerrada antes del login (escaneos, handshakes cortados...): puede que no llegue ninguna linea del log que la cierre
+	if (tcp.FIN || tcp.RST) && !session.authenticated && !session.delete {
+		session.delete = true
+		session.logoutTsMs = session.lastActivityMs
+	}
+	if len(tcp.Payload) > 0 {
+		ss.processBanner(sessionKey, session, tcp)
+	}
 }
 
 // localIface: 192.168.1.96 | listenerPort: 22 scrIp:Port = 192.168.1.89:22(ssh) | dstIp:Port = 192.168.1.202:40866
-func (ss *SshGuard) getKeyMap(ip *layers.IPv4, tcp *layers.TCP) string {
-	if ss.localIpInIface == ip.SrcIP.String() && tcp.SrcPort == layers.TCPPort(ss.SshListenPort) {
-		return fmt.Sprintf("%v:%v", ip.DstIP.String(), tcp.DstPort.String())
-	} else if ss.localIpInIface == ip.DstIP.String() {
-		return fmt.Sprintf("%v:%v", ip.SrcIP.String(), tcp.SrcPort.String())
+// en ipv6 la key queda entre corchetes: [2001:db8::1]:40866
+func (ss *SshGuard) getKeyMap(srcIP, dstIP net.IP, tcp *layers.TCP) string {
+	if ss.offline() && len(ss.OfflineLocalIps) == 0 {
+		return ss.getKeyMapByPort(srcIP, dstIP, tcp)
+	}
+	if ss.isLocalIp(srcIP) && ss.isListenPort(tcp.SrcPort) {
+		return net.JoinHostPort(dstIP.String(), strconv.Itoa(int(tcp.DstPort)))
+	} else if ss.isLocalIp(dstIP) {
+		return net.JoinHostPort(srcIP.String(), strconv.Itoa(int(tcp.SrcPort)))
 	} else {
 		//trafico para ssh en otra interfaz de red/por lo tanto otra ip
 		return ""
 	}
 }
 
+// en modo offline sin ips locales configuradas el sentido del trafico se obtiene solo del puerto de sshd
+func (ss *SshGuard) getKeyMapByPort(srcIP, dstIP net.IP, tcp *layers.TCP) string {
+	if ss.isListenPort(tcp.SrcPort) {
+		return net.JoinHostPort(dstIP.String(), strconv.Itoa(int(tcp.DstPort)))
+	} else if ss.isListenPort(tcp.DstPort) {
+		return net.JoinHostPort(srcIP.String(), strconv.Itoa(int(tcp.SrcPort)))
+	}
+	return ""
+}
+
+func (ss *SshGuard) isLocalIp(ip net.IP) bool {
+	return ss.localAddrs.contains(ip)
+}
+
+// obtiene las ips origen y destino de la capa de red, sea IPv4 o IPv6
+func getNetworkEndpoints(networkLayer gopacket.NetworkLayer) (srcIP, dstIP net.IP) {
+	switch ip := networkLayer.(type) {
+	case *layers.IPv4:
+		return ip.SrcIP, ip.DstIP
+	case *layers.IPv6:
+		return ip.SrcIP, ip.DstIP
+	}
+	return nil, nil
+}
+
+// normaliza la ip leida del log para que coincida con la que se obtiene del sniffer (sin zona y en forma canonica)
+func normalizeIP(rawIp string) string {
+	if i := strings.Index(rawIp, "%"); i != -1 {
+		rawIp = rawIp[:i]
+	}
+	if ip := net.ParseIP(rawIp); ip != nil {
+		return ip.String()
+	}
+	return rawIp
+}
+
 func formatLogBytes(bytes uint64) string {
 	const unit = 1024
 	sizes := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
@@ -455,58 +962,67 @@ func formatLogBytes(bytes uint64) string {
 	}
 	return fmt.Sprintf("%.2f%s", bytesFloat, sizes[i])
 }
-func getIPFromInterface(ifaceName string) (string, error) {
+
+// obtiene todas las ips (v4 y v6) de las interfaces. key = ip, value = interfaz
+func getIPsFromInterfaces(ifaceNames []string) (map[string]string, error) {
+	ips := make(map[string]string)
+	for _, ifaceName := range ifaceNames {
+		ifaceIps, err := getIPsFromInterface(ifaceName)
+		if err != nil {
+			return nil, err
+		}
+		for ip := range ifaceIps {
+			ips[ip] = ifaceName
+		}
+	}
+	return ips, nil
+}
+
+// obtiene todas las ips (v4 y v6) de la interfaz
+func getIPsFromInterface(ifaceName string) (map[string]struct{}, error) {
 	iface, err := net.InterfaceByName(ifaceName)
 	if err != nil {
-		return "", fmt.Errorf("error obteniendo la interfaz: %v", err)
+		return nil, fmt.Errorf("error obteniendo la interfaz: %v", err)
 	}
 
 	addrs, err := iface.Addrs()
 	if err != nil {
-		return "", fmt.Errorf("error obteniendo las direcciones: %v", err)
+		return nil, fmt.Errorf("error obteniendo las direcciones: %v", err)
 	}
 
+	ips := make(map[string]struct{})
 	for _, addr := range addrs {
 		switch v := addr.(type) {
 		case *net.IPNet:
-			if !v.IP.IsLoopback() && v.IP.To4() != nil {
-				return v.IP.String(), nil
+			if !v.IP.IsLoopback() {
+				ips[v.IP.String()] = struct{}{}
 			}
 		}
 	}
-
-	return "", fmt.Errorf("no se encontró una dirección IPv4 válida en la interfaz %s", ifaceName)
+	return ips, nil
 }
 
-// getActiveSSHSessions obtiene las sesiones SSH activas
-func getActiveSSHSessions() (sessions map[string]*sshSession) {
-	sessions = make(map[string]*sshSession)
-
-	// Ejecutar 'netstat -antp | grep sshd' para obtener IP, puerto y usuario
-	netstatCmd := exec.Command("bash", "-c", "netstat -antp | grep 'sshd:'")
-	netstatOut, err := netstatCmd.Output()
-	if err != nil {
-		log.Println("Error ejecutando 'netstat':", err)
-		return sessions
+// obtiene el timestamp de una linea del log de autenticacion. El formato clasico de syslog no tiene año ni
+// milisegundos: en vivo se usan los actuales, y en modo offline el año de la grabacion y .000 para que la
+// reproduccion de un mismo fichero de siempre el mismo resultado
+func (ss *SshGuard) lineTimestamp(line string) (int64, bool) {
+	if ss.offline() {
+		return getLineTimestamp(line, ss.offlineYear, 0)
 	}
+	now := time.Now()
+	return getLineTimestamp(line, now.Year(), now.Nanosecond()/1_000_000)
+}
 
-	netstatScanner := bufio.NewScanner(strings.NewReader(string(netstatOut)))
-	sshdRegex := regexp.MustCompile(`tcp\s+\d+\s+\d+\s+(\d+\.\d+\.\d+\.\d+):(\d+)\s+(\d+\.\d+\.\d+\.\d+):(\d+)\s+ESTABLISHED\s+\d+/sshd: (\S+)`) // Extrae IP, puerto y usuario
-
-	for netstatScanner.Scan() {
-		matches := sshdRegex.FindStringSubmatch(netstatScanner.Text())
-		if len(matches) == 6 {
-			ip := matches[3]
-			port := matches[4]
-			user := matches[5]
-			idSession := fmt.Sprintf("%v:%v", ip, port)
-			sessions[idSession] = &sshSession{user: user, ip: ip, port: port}
-		}
+func getLineTimestamp(line string, year, millis int) (int64, bool) {
+	matches := reTime.FindStringSubmatch(line)
+	if len(matches) < 2 {
+		return 0, false
 	}
-	return sessions
+	// Hora extraída, por ejemplo "Feb 13 14:55:12"
+	return getTsFromAuditLog(matches[1], year, millis), true
 }
 
-func getTsFromAuditLog(auditTsStr string) int64 {
+func getTsFromAuditLog(auditTsStr string, year, millis int) int64 {
 	now := time.Now()
 	if auditTsStr == "" {
 		return now.UnixMilli()
@@ -518,11 +1034,9 @@ func getTsFromAuditLog(auditTsStr string) int64 {
 	layoutISOshort := "2006-01-02T15:04:05-07:00"
 
 	location := now.Location()
-	millis := now.Nanosecond() / 1_000_000
 
 	// Ver si es formato clásico (comienza con 3 letras del mes)
 	if matched, _ := regexp.MatchString(`^[A-Z][a-z]{2} \s?\d{1,2} \d{2}:\d{2}:\d{2}`, auditTsStr); matched {
-		year := now.Year()
 		fullDate := fmt.Sprintf("%s.%03d %d", auditTsStr, millis, year)
 		if parsedTime, err := time.ParseInLocation(layoutClassic, fullDate, location); err == nil {
 			return parsedTime.UnixMilli()
@@ -545,6 +1059,6 @@ func getTsFromAuditLog(auditTsStr string) int64 {
 
 func init() {
 	inputs.Add("ssh_guard", func() telegraf.Input {
-		return &SshGuard{}
+		return &SshGuard{Bruteforce: defaultBruteforceConfig, Response: defaultResponseConfig, PreauthTimeoutSeconds: defaultPreauthTimeoutSeconds}
 	})
 }
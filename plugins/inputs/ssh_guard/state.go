@@ -0,0 +1,288 @@
+package ssh_guard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// version del formato del fichero de estado
+const stateVersion int = 1
+
+// posicion de lectura del log de autenticacion
+type logPosition struct {
+	Path   string `json:"path,omitempty"`
+	Inode  uint64 `json:"inode,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Cursor string `json:"cursor,omitempty"` //solo journald
+}
+
+// sesion guardada en el fichero de estado. Solo los datos que no se pueden reconstruir desde /proc
+type persistedSession struct {
+	Key             string `json:"key"`
+	User            string `json:"user,omitempty"`
+	Ip              string `json:"ip"`
+	Port            string `json:"port"`
+	Iface           string `json:"iface,omitempty"`
+	ListenPort      uint16 `json:"listenPort,omitempty"`
+	Pid             string `json:"pid,omitempty"`
+	Tty             string `json:"tty,omitempty"`
+	Authenticated   bool   `json:"authenticated,omitempty"`
+	StartTsMs       int64  `json:"startTsMs,omitempty"`
+	LoginTsMs       int64  `json:"loginTsMs,omitempty"`
+	TotalBytesSent  uint64 `json:"totalBytesSent,omitempty"`
+	TotalBytesRecv  uint64 `json:"totalBytesRecv,omitempty"`
+	TotalPackets    uint64 `json:"totalPackets,omitempty"`
+	TotalRetrans    uint64 `json:"totalRetrans,omitempty"`
+	LastActivityMs  int64  `json:"lastActivityMs,omitempty"`
+	IdleNotified    bool   `json:"idleNotified,omitempty"`
+	OverdueNotified bool   `json:"overdueNotified,omitempty"`
+	AuthMethod      string `json:"authMethod,omitempty"`
+	KeyType         string `json:"keyType,omitempty"`
+	KeyFingerprint  string `json:"keyFingerprint,omitempty"`
+	CertKeyId       string `json:"certKeyId,omitempty"`
+	ClientVersion   string `json:"clientVersion,omitempty"`
+	ServerVersion   string `json:"serverVersion,omitempty"`
+}
+
+// bloqueo de la respuesta activa, para eliminarlo al arrancar si el agente se cayo sin desbloquearlo
+type persistedBlock struct {
+	Ip      string `json:"ip"`
+	Reason  string `json:"reason,omitempty"`
+	SinceMs int64  `json:"sinceMs"`
+	UntilMs int64  `json:"untilMs"`
+}
+
+type persistedState struct {
+	Version   int                `json:"version"`
+	SavedAtMs int64              `json:"savedAtMs"`
+	LogSource string             `json:"logSource"`
+	Log       *logPosition       `json:"log,omitempty"`
+	Sessions  []persistedSession `json:"sessions"`
+	Blocks    []persistedBlock   `json:"blocks,omitempty"`
+}
+
+// guarda la posicion del log tras procesar una linea
+func (ss *SshGuard) setLogPosition(position logPosition) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.logPosition = &position
+}
+
+// escribe el estado (posicion del log y tabla de sesiones) de forma atomica: fichero temporal + fsync + rename.
+// Si no ha cambiado desde la ultima escritura no se escribe
+func (ss *SshGuard) saveState() error {
+	ss.stateMutex.Lock()
+	defer ss.stateMutex.Unlock()
+	ss.mutex.Lock()
+	state := persistedState{
+		Version:   stateVersion,
+		LogSource: ss.LogSource,
+		Log:       ss.logPosition,
+		Sessions:  make([]persistedSession, 0, len(ss.sshSessions)),
+	}
+	for key, session := range ss.sshSessions {
+		if session.delete {
+			continue
+		}
+		state.Sessions = append(state.Sessions, session.persist(key))
+	}
+	ss.mutex.Unlock()
+	if ss.responder != nil {
+		state.Blocks = ss.responder.persist()
+	}
+	//orden estable para poder comparar con el estado guardado
+	slices.SortFunc(state.Sessions, func(a, b persistedSession) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	slices.SortFunc(state.Blocks, func(a, b persistedBlock) int {
+		return strings.Compare(a.Ip, b.Ip)
+	})
+
+	//se compara sin savedAtMs, que cambia siempre
+	unchanged, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error serializando el estado: %w", err)
+	}
+	if ss.savedState != nil && string(unchanged) == string(ss.savedState) {
+		return nil
+	}
+	state.SavedAtMs = time.Now().UnixMilli()
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error serializando el estado: %w", err)
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(ss.StateFile), filepath.Base(ss.StateFile)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("error creando fichero de estado: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("error escribiendo fichero de estado: %w", err)
+	}
+	//sin fsync, tras un corte de luz el rename puede quedar en disco antes que los datos y dejar el fichero vacio
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("error escribiendo fichero de estado: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("error escribiendo fichero de estado: %w", err)
+	}
+	if err := os.Rename(tmpFile.Name(), ss.StateFile); err != nil {
+		return fmt.Errorf("error guardando fichero de estado %s: %w", ss.StateFile, err)
+	}
+	ss.savedState = unchanged
+	return nil
+}
+
+func loadState(path string) (*persistedState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("fichero de estado %s no valido: %w", path, err)
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("fichero de estado %s con version %d no soportada", path, state.Version)
+	}
+	return &state, nil
+}
+
+// restoreState recupera la posicion del log y los datos de las sesiones guardadas. Las sesiones que siguen
+// establecidas (descubiertas en /proc) recuperan usuario, login y totales. Las que ya no existen se marcan para
+// borrar: si el log reprocesado trae su logout se usa esa hora, y el resumen de sesion se envia en el siguiente intervalo
+func (ss *SshGuard) restoreState() {
+	state, err := loadState(ss.StateFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		ss.Log.Warnf("no se recupera el estado: %v", err)
+		return
+	}
+	if state.LogSource == ss.LogSource {
+		ss.restoredLogPosition = state.Log
+	}
+	restored, ended := 0, 0
+	for _, persisted := range state.Sessions {
+		session, live := ss.sshSessions[persisted.Key]
+		if !live {
+			session = newTrackedSession(persisted.Ip, persisted.Port, persisted.StartTsMs)
+			session.delete = true
+			ss.sshSessions[persisted.Key] = session
+			ended++
+		} else {
+			restored++
+		}
+		ss.restoreSession(session, persisted)
+	}
+	ss.Log.Infof("estado recuperado de %s: %d sesiones activas, %d finalizadas mientras el agente estaba parado", ss.StateFile, restored, ended)
+	if ss.responder != nil && len(state.Blocks) != 0 {
+		//los expirados se eliminan en la primera comprobacion tras arrancar, el resto al expirar
+		ss.responder.restore(state.Blocks)
+		ss.Log.Infof("%d bloqueos recuperados de %s", len(state.Blocks), ss.StateFile)
+	}
+}
+
+func (r *responder) persist() []persistedBlock {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	blocks := make([]persistedBlock, 0, len(r.blocks))
+	for ip, block := range r.blocks {
+		blocks = append(blocks, persistedBlock{Ip: ip, Reason: block.reason, SinceMs: block.sinceMs, UntilMs: block.untilMs})
+	}
+	return blocks
+}
+
+func (r *responder) restore(blocks []persistedBlock) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, persisted := range blocks {
+		if net.ParseIP(persisted.Ip) == nil {
+			continue
+		}
+		r.blocks[persisted.Ip] = &activeBlock{reason: persisted.Reason, sinceMs: persisted.SinceMs, untilMs: persisted.UntilMs}
+	}
+}
+
+func (ss *SshGuard) restoreSession(session *sshSession, persisted persistedSession) {
+	if persisted.User != "" {
+		session.user = persisted.User
+	}
+	session.iface = persisted.Iface
+	if lp := ss.listenPortByNumber(persisted.ListenPort); lp != nil {
+		session.listenPort = lp
+	}
+	if persisted.Pid != "" {
+		session.pid = persisted.Pid
+		//el pid de una sesion que termino con el agente parado puede ser ya de otro proceso
+		if !session.delete {
+			ss.sessionPids[persisted.Pid] = session
+		}
+	}
+	if persisted.Tty != "" {
+		session.tty = persisted.Tty
+	}
+	session.authenticated = session.authenticated || persisted.Authenticated
+	if persisted.StartTsMs != 0 {
+		session.startTsMs = persisted.StartTsMs
+	}
+	if persisted.LoginTsMs != 0 {
+		session.loginTsMs = persisted.LoginTsMs
+	}
+	session.totalBytesSent = persisted.TotalBytesSent
+	session.totalBytesRecv = persisted.TotalBytesRecv
+	session.totalPackets = persisted.TotalPackets
+	session.totalRetrans = persisted.TotalRetrans
+	if persisted.LastActivityMs != 0 {
+		session.lastActivityMs = persisted.LastActivityMs
+	}
+	session.idleNotified = persisted.IdleNotified
+	session.overdueNotified = persisted.OverdueNotified
+	session.authMethod = persisted.AuthMethod
+	session.keyType = persisted.KeyType
+	session.keyFingerprint = persisted.KeyFingerprint
+	session.certKeyId = persisted.CertKeyId
+	session.clientVersion = persisted.ClientVersion
+	session.serverVersion = persisted.ServerVersion
+}
+
+func (s *sshSession) persist(key string) persistedSession {
+	persisted := persistedSession{
+		Key:             key,
+		User:            s.user,
+		Ip:              s.ip,
+		Port:            s.port,
+		Iface:           s.iface,
+		Pid:             s.pid,
+		Tty:             s.tty,
+		Authenticated:   s.authenticated,
+		StartTsMs:       s.startTsMs,
+		LoginTsMs:       s.loginTsMs,
+		TotalBytesSent:  s.totalBytesSent,
+		TotalBytesRecv:  s.totalBytesRecv,
+		TotalPackets:    s.totalPackets,
+		TotalRetrans:    s.totalRetrans,
+		LastActivityMs:  s.lastActivityMs,
+		IdleNotified:    s.idleNotified,
+		OverdueNotified: s.overdueNotified,
+		AuthMethod:      s.authMethod,
+		KeyType:         s.keyType,
+		KeyFingerprint:  s.keyFingerprint,
+		CertKeyId:       s.certKeyId,
+		ClientVersion:   s.clientVersion,
+		ServerVersion:   s.serverVersion,
+	}
+	if s.listenPort != nil {
+		persisted.ListenPort = s.listenPort.Port
+	}
+	return persisted
+}
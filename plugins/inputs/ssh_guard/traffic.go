@@ -0,0 +1,38 @@
+package ssh_guard
+
+import "github.com/gopacket/gopacket/layers"
+
+// tcpSeqTracker detecta retransmisiones en un sentido de la conexion: segmentos con datos que no pasan del mayor
+// numero de secuencia ya visto. Las comparaciones son en aritmetica de 32 bits para soportar la vuelta del contador.
+// Los keep-alive TCP con 1 byte de datos tambien se cuentan como retransmision
+type tcpSeqTracker struct {
+	next        uint32 //siguiente numero de secuencia esperado
+	initialized bool
+}
+
+func (t *tcpSeqTracker) isRetransmission(tcp *layers.TCP) bool {
+	if len(tcp.Payload) == 0 {
+		return false
+	}
+	end := tcp.Seq + uint32(len(tcp.Payload))
+	if !t.initialized {
+		t.initialized = true
+		t.next = end
+		return false
+	}
+	if int32(end-t.next) <= 0 {
+		return true
+	}
+	t.next = end
+	return false
+}
+
+// campos de trafico de un sentido de la sesion en el intervalo
+func addTrafficFields(fields map[string]interface{}, bytes, packets, retransmissions, intervalSeconds uint64) {
+	fields["connbytes"] = bytes
+	fields["packets"] = packets
+	fields["retransmissions"] = retransmissions
+	if intervalSeconds > 0 {
+		fields["bytesPerSecond"] = float64(bytes) / float64(intervalSeconds)
+	}
+}
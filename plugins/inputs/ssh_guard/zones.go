@@ -0,0 +1,164 @@
+package ssh_guard
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	system_utils "github.com/influxdata/telegraf/plugins/common/system"
+)
+
+var SSH_ZONE_VIOLATION eventType = "ssh_zone_violation"
+
+// zona de las ips que no estan en ninguna zona configurada
+const ZONE_UNTRUSTED string = "untrusted"
+
+// en allowedZones, zonas permitidas para los usuarios sin entrada propia
+const ALL_USERS string = "*"
+
+// Zone es una red de origen con nombre (corporate_vpn, local_lan, support_jump...)
+type Zone struct {
+	Name  string   `toml:"name"`
+	Cidrs []string `toml:"cidrs"` //redes en formato CIDR o ips sueltas
+	nets  []*net.IPNet
+}
+
+// clasificador de ips en zonas. Las zonas se comprueban en el orden configurado y se usa la primera que contenga la ip
+type zoneClassifier struct {
+	zones   []*Zone
+	allowed map[string][]string //usuario => zonas desde las que puede hacer login
+}
+
+func newZoneClassifier(zones []*Zone, allowed map[string][]string) (*zoneClassifier, error) {
+	zc := &zoneClassifier{allowed: allowed}
+	for _, z := range zones {
+		if z.Name == "" || z.Name == ZONE_UNTRUSTED {
+			return nil, fmt.Errorf("zones: nombre de zona no valido %q", z.Name)
+		}
+		if slices.ContainsFunc(zc.zones, func(other *Zone) bool { return other.Name == z.Name }) {
+			return nil, fmt.Errorf("zones: zona %q duplicada", z.Name)
+		}
+		zone := &Zone{Name: z.Name, Cidrs: z.Cidrs}
+		for _, cidr := range z.Cidrs {
+			ipNet, err := parseZoneCidr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("zones: zona %q: %w", z.Name, err)
+			}
+			zone.nets = append(zone.nets, ipNet)
+		}
+		zc.zones = append(zc.zones, zone)
+	}
+	for user, zoneNames := range allowed {
+		for _, name := range zoneNames {
+			if name != ZONE_UNTRUSTED && !slices.ContainsFunc(zc.zones, func(z *Zone) bool { return z.Name == name }) {
+				return nil, fmt.Errorf("allowedZones: zona %q del usuario %q no configurada", name, user)
+			}
+		}
+	}
+	return zc, nil
+}
+
+// acepta "10.0.0.0/8" o una ip suelta ("192.168.1.10" => /32)
+func parseZoneCidr(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("red no valida %q", cidr)
+		}
+		bits := net.IPv6len * 8
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = net.IPv4len * 8
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("red no valida %q", cidr)
+	}
+	return ipNet, nil
+}
+
+// zona de la ip, o untrusted si no esta en ninguna
+func (zc *zoneClassifier) classify(rawIp string) string {
+	ip := net.ParseIP(rawIp)
+	if ip == nil {
+		return ZONE_UNTRUSTED
+	}
+	for _, zone := range zc.zones {
+		for _, ipNet := range zone.nets {
+			if ipNet.Contains(ip) {
+				return zone.Name
+			}
+		}
+	}
+	return ZONE_UNTRUSTED
+}
+
+// zonas permitidas para el usuario. nil si no tiene restricciones
+func (zc *zoneClassifier) allowedZones(user string) []string {
+	if zones, found := zc.allowed[user]; found {
+		return zones
+	}
+	return zc.allowed[ALL_USERS]
+}
+
+// alerta de login correcto desde fuera de las zonas permitidas del usuario
+type zoneViolation struct {
+	user    string
+	ip      string
+	port    string
+	zone    string
+	allowed []string
+	session *sshSession
+	tsMs    int64
+}
+
+func (zv *zoneViolation) TelegrafNormalize() system_utils.TelegrafEvent {
+	tags := map[string]string{
+		"group":     "SSH",
+		"eventType": string(SSH_ZONE_VIOLATION),
+		"user":      zv.user,
+		"ip":        zv.ip,
+		"port":      zv.port,
+		"zone":      zv.zone,
+	}
+	if zv.session != nil {
+		zv.session.addAuthTags(tags)
+		if zv.session.listenPort != nil {
+			tags["sshInstance"] = zv.session.listenPort.name()
+		}
+	}
+	return system_utils.TelegrafEvent{
+		Fields: map[string]interface{}{
+			"allowedZones": strings.Join(zv.allowed, ","),
+		},
+		Tags:     tags,
+		DeviceID: system_utils.GetUniqueID(),
+		Time:     time.UnixMilli(zv.tsMs),
+	}
+}
+
+// comprueba que el login venga de una zona permitida para el usuario
+func (ss *SshGuard) checkLoginZone(login *sshSession) {
+	allowed := ss.zones.allowedZones(login.user)
+	if allowed == nil {
+		return
+	}
+	zone := ss.zones.classify(login.ip)
+	if slices.Contains(allowed, zone) {
+		return
+	}
+	ss.Log.Warnf("login de %s desde %s (zona %s) fuera de sus zonas permitidas %v", login.user, login.ip, zone, allowed)
+	ss.addMetric(&zoneViolation{
+		user:    login.user,
+		ip:      login.ip,
+		port:    login.port,
+		zone:    zone,
+		allowed: allowed,
+		session: login,
+		tsMs:    login.tsMs,
+	})
+}
@@ -0,0 +1,302 @@
+package usb_guard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	system_utils "github.com/influxdata/telegraf/plugins/common/system"
+	"github.com/pilebones/go-udev/netlink"
+)
+
+const BLOCKED string = "blocked"
+
+// modos de bloqueo: off no hace nada, report solo informa de lo que se bloquearia y enforce escribe en sysfs
+const (
+	ENFORCE_OFF    string = "off"
+	ENFORCE_REPORT string = "report"
+	ENFORCE_BLOCK  string = "enforce"
+)
+
+var enforceModes = []string{ENFORCE_OFF, ENFORCE_REPORT, ENFORCE_BLOCK}
+
+// dispositivo usb en sysfs: "1-2", "1-2.4.1". Los root hubs son "usb1", "usb2"...
+var reUsbSysfsDevice = regexp.MustCompile(`^\d+-\d+(?:\.\d+)*$`)
+var reUsbRootHub = regexp.MustCompile(`^usb\d+$`)
+
+// con bloqueo se reciben siempre los eventos usb_device, aunque las reglas configuradas no los incluyan
+var enforceUsbRule = &UsbRule{Name: "enforce", Subsystem: "usb", DevType: "usb_device"}
+
+// EnforceConfig bloquea los dispositivos que no estan permitidos por la politica escribiendo 0 en
+// /sys/bus/usb/devices/<dev>/authorized
+type EnforceConfig struct {
+	Mode string `toml:"mode"` //off, report o enforce
+	//authorized_default de los root hubs mientras el plugin esta arrancado: "0" ningun dispositivo nuevo se autoriza
+	//hasta que la politica lo permite, "1" todos, "2" solo los internos. Vacio para no cambiarlo
+	AuthorizedDefault string `toml:"authorizedDefault"`
+}
+
+var defaultEnforceConfig = EnforceConfig{Mode: ENFORCE_OFF}
+
+type usbEnforcer struct {
+	mode              string
+	devicesDir        string
+	authorizedDefault string
+	savedDefaults     map[string]string //root hub => authorized_default original
+}
+
+func newUsbEnforcer(config EnforceConfig, devicesDir string) (*usbEnforcer, error) {
+	if !slices.Contains(enforceModes, config.Mode) {
+		return nil, fmt.Errorf("enforce: modo %q no soportado. Valores posibles: %q", config.Mode, enforceModes)
+	}
+	if config.AuthorizedDefault != "" && !slices.Contains([]string{"0", "1", "2"}, config.AuthorizedDefault) {
+		return nil, fmt.Errorf("enforce: authorizedDefault %q no valido. Valores posibles: \"0\", \"1\", \"2\"", config.AuthorizedDefault)
+	}
+	return &usbEnforcer{
+		mode:              config.Mode,
+		devicesDir:        devicesDir,
+		authorizedDefault: config.AuthorizedDefault,
+		savedDefaults:     make(map[string]string),
+	}, nil
+}
+
+// cambia authorized_default en los root hubs y guarda el valor original para restaurarlo al parar. Si falla en algun
+// hub se restauran los ya cambiados. El valor original solo se guarda en memoria: si el agente se cae sin parar,
+// authorized_default se queda cambiado hasta el siguiente arranque del sistema
+func (ue *usbEnforcer) applyAuthorizedDefault() (err error) {
+	if ue.authorizedDefault == "" || ue.mode != ENFORCE_BLOCK {
+		return nil
+	}
+	hubs, err := ue.rootHubs()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			for _, restoreErr := range ue.restoreAuthorizedDefault() {
+				err = fmt.Errorf("%w (%v)", err, restoreErr)
+			}
+		}
+	}()
+	for _, hub := range hubs {
+		path := filepath.Join(ue.devicesDir, hub, "authorized_default")
+		original, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("enforce: error leyendo %s: %w", path, err)
+		}
+		if err := os.WriteFile(path, []byte(ue.authorizedDefault), 0644); err != nil {
+			return fmt.Errorf("enforce: error escribiendo %s: %w", path, err)
+		}
+		ue.savedDefaults[hub] = strings.TrimSpace(string(original))
+	}
+	return nil
+}
+
+// deja authorized_default como estaba al arrancar. Los dispositivos ya bloqueados siguen bloqueados
+func (ue *usbEnforcer) restoreAuthorizedDefault() []error {
+	var errs []error
+	for hub, original := range ue.savedDefaults {
+		path := filepath.Join(ue.devicesDir, hub, "authorized_default")
+		if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+			errs = append(errs, fmt.Errorf("enforce: error restaurando %s: %w", path, err))
+		}
+	}
+	ue.savedDefaults = make(map[string]string)
+	return errs
+}
+
+func (ue *usbEnforcer) rootHubs() ([]string, error) {
+	entries, err := os.ReadDir(ue.devicesDir)
+	if err != nil {
+		return nil, fmt.Errorf("enforce: error leyendo %s: %w", ue.devicesDir, err)
+	}
+	var hubs []string
+	for _, entry := range entries {
+		if reUsbRootHub.MatchString(entry.Name()) {
+			hubs = append(hubs, entry.Name())
+		}
+	}
+	return hubs, nil
+}
+
+// dispositivo conectado a un puerto interno: removable es "fixed" segun el descriptor del hub
+func (ue *usbEnforcer) builtin(sysfsName string) bool {
+	removable, err := os.ReadFile(filepath.Join(ue.devicesDir, sysfsName, "removable"))
+	return err == nil && strings.TrimSpace(string(removable)) == "fixed"
+}
+
+// escribe en authorized del dispositivo. Solo si cambia, para no reiniciar el dispositivo sin necesidad
+func (ue *usbEnforcer) setAuthorized(sysfsName string, authorized bool) (bool, error) {
+	if !reUsbSysfsDevice.MatchString(sysfsName) {
+		return false, fmt.Errorf("enforce: dispositivo usb no valido %q", sysfsName)
+	}
+	value := "0"
+	if authorized {
+		value = "1"
+	}
+	path := filepath.Join(ue.devicesDir, sysfsName, "authorized")
+	current, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("enforce: error leyendo %s: %w", path, err)
+	}
+	if strings.TrimSpace(string(current)) == value {
+		return false, nil
+	}
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return false, fmt.Errorf("enforce: error escribiendo %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// nombre en sysfs del dispositivo usb al que pertenece el evento, a partir de DEVPATH:
+// "/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2:1.0/host3/.../block/sdb" => "1-2"
+func usbSysfsName(devpath string) string {
+	name := ""
+	for _, part := range strings.Split(devpath, "/") {
+		if reUsbSysfsDevice.MatchString(part) {
+			name = part
+		}
+	}
+	return name
+}
+
+// aplica la politica a un dispositivo recien conectado, con los datos del evento usb_device. Las entradas de la politica
+// por fsUuid no se pueden comprobar aun (el disco aparece despues de autorizar el dispositivo)
+func (us *UsbsGuard) enforceNewDevice(ev netlink.UEvent) {
+	device := newUsbDev(ev, CONNECTED, time.Now())
+	device.Policy, device.PolicyRule = us.policy.evaluate(device)
+	us.enforcePolicy(device)
+}
+
+// aplica la politica a los dispositivos que ya estaban conectados al arrancar, leyendolos de sysfs
+func (us *UsbsGuard) enforcePresentDevices() {
+	entries, err := os.ReadDir(us.enforcer.devicesDir)
+	if err != nil {
+		us.Log.Errorf("enforce: error leyendo %s: %v", us.enforcer.devicesDir, err)
+		return
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if !reUsbSysfsDevice.MatchString(entry.Name()) {
+			continue
+		}
+		device := readSysfsUsbDevice(us.enforcer.devicesDir, entry.Name(), now)
+		device.Policy, device.PolicyRule = us.policy.evaluate(device)
+		us.enforcePolicy(device)
+	}
+}
+
+// dispositivo conectado a partir de sus atributos en sysfs (idVendor, idProduct, serial, bDeviceClass)
+func readSysfsUsbDevice(devicesDir, sysfsName string, now time.Time) *UsbDev {
+	attr := func(name string) string {
+		value, err := os.ReadFile(filepath.Join(devicesDir, sysfsName, name))
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(value))
+	}
+	vendorId, productId := attr("idVendor"), attr("idProduct")
+	device := &UsbDev{
+		Timestamp:      now.UnixMilli(),
+		State:          CONNECTED,
+		ManufacturerId: fmt.Sprintf("%v:%v", productId, vendorId),
+		Interface:      sysfsName,
+		IdSerialShort:  attr("serial"),
+		DeviceClass:    UNKNOWN,
+		Driver:         UNKNOWN,
+		VendorId:       vendorId,
+		ProductId:      productId,
+		SysfsName:      sysfsName,
+	}
+	//clase 0: se define por interfaz, se usa la de la primera
+	class := attr("bDeviceClass")
+	if class == "00" {
+		if ifaces, _ := filepath.Glob(filepath.Join(devicesDir, sysfsName+":*", "bInterfaceClass")); len(ifaces) != 0 {
+			slices.Sort(ifaces)
+			if value, err := os.ReadFile(ifaces[0]); err == nil {
+				class = strings.TrimSpace(string(value))
+			}
+		}
+	}
+	if parsed, err := strconv.ParseUint(class, 16, 8); err == nil {
+		device.DeviceClass = usbClassName(uint8(parsed))
+	}
+	if drivers := sysfsInterfaceDrivers(devicesDir, sysfsName); drivers != "" {
+		device.Driver = drivers
+	}
+	return device
+}
+
+// aplica la politica al dispositivo conectado: bloquea los que no estan permitidos (los hubs y los internos solo si estan
+// denegados) y, si los root hubs no autorizan los dispositivos nuevos, autoriza el resto
+func (us *UsbsGuard) enforcePolicy(device *UsbDev) {
+	if device.SysfsName == "" {
+		us.Log.Warnf("enforce: no se conoce el dispositivo usb de %v", device.Interface)
+		return
+	}
+	//sin entrada en la politica no se bloquean los hubs (se perderian los dispositivos permitidos conectados a ellos)
+	//ni los dispositivos internos (modem WWAN, lector de huellas, camara...)
+	reason := ""
+	switch {
+	case device.Policy == POLICY_ALLOWED:
+		reason = "la política " + device.PolicyRule
+	case device.Policy == POLICY_DENIED:
+	case device.DeviceClass == usbClassName(USB_CLASS_HUB):
+		reason = "ser un hub"
+	case us.enforcer.builtin(device.SysfsName):
+		reason = "ser un dispositivo interno"
+	}
+	if reason != "" {
+		if us.enforcer.mode != ENFORCE_BLOCK || us.enforcer.authorizedDefault != "0" {
+			return
+		}
+		if changed, err := us.enforcer.setAuthorized(device.SysfsName, true); err != nil {
+			us.Log.Error(err)
+		} else if changed {
+			us.Log.Infof("dispositivo %v (%v) autorizado por %v", device.SysfsName, device.Interface, reason)
+		}
+		return
+	}
+	if us.enforcer.mode == ENFORCE_BLOCK {
+		if _, err := us.enforcer.setAuthorized(device.SysfsName, false); err != nil {
+			us.Log.Error(err)
+			return
+		}
+	}
+	us.Log.Warnf("dispositivo %v (%v) bloqueado (modo %v) | vendor:product %v:%v | política: %v %v", device.SysfsName, device.Interface, us.enforcer.mode, device.VendorId, device.ProductId, device.Policy, device.PolicyRule)
+	blocked := (&usbBlocked{device: device, mode: us.enforcer.mode, tsMs: time.Now().UnixMilli()}).TelegrafNormalize()
+	us.acc.AddFields(blocked.GetDeviceID(), blocked.GetFields(), blocked.GetTags(), blocked.GetTime())
+}
+
+// dispositivo bloqueado, o que se bloquearia en modo report
+type usbBlocked struct {
+	device *UsbDev
+	mode   string
+	tsMs   int64
+}
+
+func (ub *usbBlocked) TelegrafNormalize() system_utils.TelegrafEvent {
+	u := ub.device
+	tags := u.deviceTags()
+	tags["enforcement"] = ub.mode
+	fields := map[string]interface{}{
+		"state":     BLOCKED,
+		"sysfsName": u.SysfsName,
+		"vendorId":  u.VendorId,
+		"productId": u.ProductId,
+	}
+	if u.PolicyRule != "" {
+		fields["rule"] = u.PolicyRule
+	}
+	return system_utils.TelegrafEvent{
+		Fields:   fields,
+		Tags:     tags,
+		DeviceID: system_utils.GetUniqueID(),
+		Time:     time.UnixMilli(ub.tsMs),
+	}
+}
@@ -0,0 +1,184 @@
+package usb_guard
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	system_utils "github.com/influxdata/telegraf/plugins/common/system"
+	"github.com/influxdata/toml"
+)
+
+const USB_POLICY_VIOLATION string = "usb_policy_violation"
+
+// resultado de evaluar un dispositivo contra la politica
+const (
+	POLICY_ALLOWED string = "allowed"
+	POLICY_DENIED  string = "denied"
+	POLICY_UNKNOWN string = "unknown"
+)
+
+// UsbPolicy son los dispositivos permitidos y denegados. Se puede configurar en linea o en un fichero TOML
+// externo con las mismas tablas allow y deny, que se añaden a las configuradas en linea
+type UsbPolicy struct {
+	File  string            `toml:"file"`
+	Allow []*UsbPolicyEntry `toml:"allow"`
+	Deny  []*UsbPolicyEntry `toml:"deny"`
+}
+
+// UsbPolicyEntry identifica dispositivos. Se tienen que cumplir todos los campos configurados
+type UsbPolicyEntry struct {
+	Name      string `toml:"name"`
+	VendorId  string `toml:"vendorId"`  //idVendor en hex ("0781")
+	ProductId string `toml:"productId"` //idProduct en hex ("5567")
+	Serial    string `toml:"serial"`    //numero de serie (ID_SERIAL_SHORT)
+	Class     string `toml:"class"`     //clase USB en hex o por nombre, como en las reglas
+	FsUuid    string `toml:"fsUuid"`    //UUID del sistema de ficheros (ID_FS_UUID_ENC)
+	vendor    uint16
+	product   uint16
+	class     string
+}
+
+// politica compilada. Deny tiene prioridad sobre allow, y un dispositivo que no esta en ninguna lista es unknown
+type usbPolicy struct {
+	allow []*UsbPolicyEntry
+	deny  []*UsbPolicyEntry
+}
+
+func (p *UsbPolicy) configured() bool {
+	return p.File != "" || len(p.Allow) != 0 || len(p.Deny) != 0
+}
+
+// newUsbPolicy valida las entradas en linea y las del fichero externo
+func newUsbPolicy(config UsbPolicy) (*usbPolicy, error) {
+	allow, deny := config.Allow, config.Deny
+	if config.File != "" {
+		data, err := os.ReadFile(config.File)
+		if err != nil {
+			return nil, fmt.Errorf("policy: error leyendo %s: %w", config.File, err)
+		}
+		var external UsbPolicy
+		if err := toml.Unmarshal(data, &external); err != nil {
+			return nil, fmt.Errorf("policy: fichero %s no valido: %w", config.File, err)
+		}
+		allow = append(append([]*UsbPolicyEntry{}, allow...), external.Allow...)
+		deny = append(append([]*UsbPolicyEntry{}, deny...), external.Deny...)
+	}
+	policy := &usbPolicy{}
+	for _, entry := range allow {
+		compiled, err := entry.compile()
+		if err != nil {
+			return nil, fmt.Errorf("policy: allow %q: %w", entry.Name, err)
+		}
+		policy.allow = append(policy.allow, compiled)
+	}
+	for _, entry := range deny {
+		compiled, err := entry.compile()
+		if err != nil {
+			return nil, fmt.Errorf("policy: deny %q: %w", entry.Name, err)
+		}
+		policy.deny = append(policy.deny, compiled)
+	}
+	return policy, nil
+}
+
+func (e *UsbPolicyEntry) compile() (*UsbPolicyEntry, error) {
+	if e.VendorId == "" && e.ProductId == "" && e.Serial == "" && e.Class == "" && e.FsUuid == "" {
+		return nil, fmt.Errorf("la entrada no tiene ninguna condición")
+	}
+	entry := *e
+	var err error
+	if entry.vendor, err = parseUsbId(e.VendorId); err != nil {
+		return nil, fmt.Errorf("vendorId: %w", err)
+	}
+	if entry.product, err = parseUsbId(e.ProductId); err != nil {
+		return nil, fmt.Errorf("productId: %w", err)
+	}
+	if e.Class != "" {
+		class, err := parseUsbClass(e.Class)
+		if err != nil {
+			return nil, err
+		}
+		entry.class = usbClassName(class)
+	}
+	return &entry, nil
+}
+
+// nombres de las entradas allow que comprueban el UUID del sistema de ficheros
+func (p *usbPolicy) fsUuidAllowEntries() []string {
+	var names []string
+	for _, entry := range p.allow {
+		if entry.FsUuid != "" {
+			names = append(names, entry.Name)
+		}
+	}
+	return names
+}
+
+// evalua el dispositivo: allowed, denied o unknown, y el nombre de la entrada que lo decide
+func (p *usbPolicy) evaluate(u *UsbDev) (string, string) {
+	for _, entry := range p.deny {
+		if entry.matches(u) {
+			return POLICY_DENIED, entry.Name
+		}
+	}
+	for _, entry := range p.allow {
+		if entry.matches(u) {
+			return POLICY_ALLOWED, entry.Name
+		}
+	}
+	return POLICY_UNKNOWN, ""
+}
+
+func (e *UsbPolicyEntry) matches(u *UsbDev) bool {
+	if e.VendorId != "" && !sameUsbId(u.VendorId, e.vendor) {
+		return false
+	}
+	if e.ProductId != "" && !sameUsbId(u.ProductId, e.product) {
+		return false
+	}
+	if e.Serial != "" && e.Serial != u.IdSerialShort {
+		return false
+	}
+	if e.class != "" && e.class != u.DeviceClass {
+		return false
+	}
+	if e.FsUuid != "" && !strings.EqualFold(e.FsUuid, u.IdFsUuidEnc) {
+		return false
+	}
+	return true
+}
+
+func sameUsbId(raw string, id uint16) bool {
+	if raw == "" {
+		return false
+	}
+	parsed, err := parseUsbId(raw)
+	return err == nil && parsed == id
+}
+
+// alerta de dispositivo conectado que no esta permitido por la politica
+type usbPolicyViolation struct {
+	device *UsbDev
+}
+
+func (pv *usbPolicyViolation) TelegrafNormalize() system_utils.TelegrafEvent {
+	u := pv.device
+	tags := u.deviceTags()
+	tags["eventType"] = USB_POLICY_VIOLATION
+	fields := map[string]interface{}{
+		"state":     u.State,
+		"vendorId":  u.VendorId,
+		"productId": u.ProductId,
+	}
+	if u.PolicyRule != "" {
+		fields["rule"] = u.PolicyRule
+	}
+	return system_utils.TelegrafEvent{
+		Fields:   fields,
+		Tags:     tags,
+		DeviceID: system_utils.GetUniqueID(),
+		Time:     time.UnixMilli(u.Timestamp),
+	}
+}
@@ -0,0 +1,272 @@
+package usb_guard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pilebones/go-udev/netlink"
+)
+
+// valor de los tags device_class y driver cuando el evento no los trae
+const UNKNOWN string = "unknown"
+
+const USB_CLASS_HUB uint8 = 0x09
+
+// clases USB (bDeviceClass/bInterfaceClass) con nombre
+var usbClassNames = map[uint8]string{
+	0x01: "audio",
+	0x02: "communications",
+	0x03: "hid",
+	0x05: "physical",
+	0x06: "image",
+	0x07: "printer",
+	0x08: "mass_storage",
+	0x09: "hub",
+	0x0a: "cdc_data",
+	0x0b: "smart_card",
+	0x0d: "content_security",
+	0x0e: "video",
+	0x0f: "personal_healthcare",
+	0x10: "audio_video",
+	0x11: "billboard",
+	0x12: "type_c_bridge",
+	0xdc: "diagnostic",
+	0xe0: "wireless",
+	0xef: "miscellaneous",
+	0xfe: "application_specific",
+	0xff: "vendor_specific",
+}
+
+// UsbRule selecciona los eventos de udev que se monitorizan. Los campos vacios no se comprueban,
+// y un evento se monitoriza si cumple alguna de las reglas
+type UsbRule struct {
+	Name      string `toml:"name"`
+	Subsystem string `toml:"subsystem"` //usb, block, input, net, tty...
+	DevType   string `toml:"devType"`   //usb_device, usb_interface, disk, partition...
+	Driver    string `toml:"driver"`    //usb-storage, usbhid, cdc_acm, ftdi_sio, rndis_host...
+	Class     string `toml:"class"`     //clase USB del dispositivo o de alguna de sus interfaces: en hex ("08", "0x08") o por nombre ("mass_storage")
+	VendorId  string `toml:"vendorId"`  //idVendor en hex ("0781")
+	ProductId string `toml:"productId"` //idProduct en hex ("5567")
+}
+
+// reglas por defecto: todos los dispositivos USB (un evento usb_device por dispositivo, sea de la clase que sea)
+// y los discos y particiones de usb-storage, que traen el UUID del sistema de ficheros
+var defaultUsbRules = []*UsbRule{
+	{Name: "usb_devices", Subsystem: "usb", DevType: "usb_device"},
+	{Name: "usb_storage", Driver: "usb-storage"},
+}
+
+// compileUsbRules convierte las reglas en el matcher de go-udev
+func compileUsbRules(rules []*UsbRule) (*netlink.RuleDefinitions, error) {
+	definitions := &netlink.RuleDefinitions{}
+	for _, rule := range rules {
+		ruleDefinitions, err := rule.definitions()
+		if err != nil {
+			return nil, fmt.Errorf("regla %q: %w", rule.Name, err)
+		}
+		for _, definition := range ruleDefinitions {
+			definitions.AddRule(definition)
+		}
+	}
+	if err := definitions.Compile(); err != nil {
+		return nil, fmt.Errorf("error compilando las reglas: %w", err)
+	}
+	return definitions, nil
+}
+
+// cada campo de la regla se puede encontrar en varias variables del evento: DRIVER o ID_USB_DRIVER (udev),
+// TYPE (usb_device), INTERFACE (usb_interface) o ID_USB_INTERFACES (udev)... Las variables de go-udev son regex
+// que deben cumplirse todas, asi que la regla se convierte en una definicion por cada combinacion de alternativas
+func (r *UsbRule) definitions() ([]netlink.RuleDefinition, error) {
+	if r.Subsystem == "" && r.DevType == "" && r.Driver == "" && r.Class == "" && r.VendorId == "" && r.ProductId == "" {
+		return nil, fmt.Errorf("la regla no tiene ninguna condición")
+	}
+	envs := []map[string]string{{}}
+	combine := func(alternatives ...map[string]string) {
+		var combined []map[string]string
+		for _, env := range envs {
+			for _, alternative := range alternatives {
+				merged := make(map[string]string, len(env)+len(alternative))
+				for k, v := range env {
+					merged[k] = v
+				}
+				for k, v := range alternative {
+					merged[k] = v
+				}
+				combined = append(combined, merged)
+			}
+		}
+		envs = combined
+	}
+	if r.Subsystem != "" {
+		combine(map[string]string{"SUBSYSTEM": exactRegex(r.Subsystem)})
+	}
+	if r.DevType != "" {
+		combine(map[string]string{"DEVTYPE": exactRegex(r.DevType)})
+	}
+	if r.Driver != "" {
+		combine(map[string]string{"ID_USB_DRIVER": exactRegex(r.Driver)}, map[string]string{"DRIVER": exactRegex(r.Driver)})
+	}
+	if r.Class != "" {
+		class, err := parseUsbClass(r.Class)
+		if err != nil {
+			return nil, err
+		}
+		//TYPE e INTERFACE en decimal ("8/6/80"), ID_USB_INTERFACES en hex (":080650:030101:")
+		combine(
+			map[string]string{"TYPE": fmt.Sprintf(`^%d/`, class)},
+			map[string]string{"INTERFACE": fmt.Sprintf(`^%d/`, class)},
+			map[string]string{"ID_USB_INTERFACES": fmt.Sprintf(`^:(?:[0-9a-f]{6}:)*%02x[0-9a-f]{4}:`, class)},
+		)
+	}
+	if r.VendorId != "" || r.ProductId != "" {
+		vendor, err := parseUsbId(r.VendorId)
+		if err != nil {
+			return nil, fmt.Errorf("vendorId: %w", err)
+		}
+		product, err := parseUsbId(r.ProductId)
+		if err != nil {
+			return nil, fmt.Errorf("productId: %w", err)
+		}
+		//udev: ID_VENDOR_ID/ID_MODEL_ID con 4 digitos. Kernel: PRODUCT=vendor/product/bcdDevice sin ceros a la izquierda
+		udevEnv := make(map[string]string)
+		productEnv := `(?i)^`
+		if r.VendorId != "" {
+			udevEnv["ID_VENDOR_ID"] = fmt.Sprintf(`(?i)^%04x$`, vendor)
+			productEnv += fmt.Sprintf(`%x/`, vendor)
+		} else {
+			productEnv += `[0-9a-f]+/`
+		}
+		if r.ProductId != "" {
+			udevEnv["ID_MODEL_ID"] = fmt.Sprintf(`(?i)^%04x$`, product)
+			productEnv += fmt.Sprintf(`%x/`, product)
+		}
+		combine(udevEnv, map[string]string{"PRODUCT": productEnv})
+	}
+	definitions := make([]netlink.RuleDefinition, 0, len(envs))
+	for _, env := range envs {
+		definitions = append(definitions, netlink.RuleDefinition{Env: env})
+	}
+	return definitions, nil
+}
+
+func exactRegex(value string) string {
+	return "^" + regexp.QuoteMeta(value) + "$"
+}
+
+// acepta la clase en hex ("08", "0x08") o por nombre ("mass_storage")
+func parseUsbClass(raw string) (uint8, error) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	for class, name := range usbClassNames {
+		if name == raw {
+			return class, nil
+		}
+	}
+	class, err := strconv.ParseUint(strings.TrimPrefix(raw, "0x"), 16, 8)
+	if err != nil {
+		return 0, fmt.Errorf("clase USB no valida %q", raw)
+	}
+	return uint8(class), nil
+}
+
+// vendorId y productId en hex de 16 bits ("0781", "0x0781"). Vacio si no se comprueba
+func parseUsbId(raw string) (uint16, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(raw), "0x"), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("id USB no valido %q", raw)
+	}
+	return uint16(id), nil
+}
+
+// nombre de la clase de una clase USB. Las que no tienen nombre se devuelven en hex ("class_0xfd")
+func usbClassName(class uint8) string {
+	if name, found := usbClassNames[class]; found {
+		return name
+	}
+	return fmt.Sprintf("class_0x%02x", class)
+}
+
+// clase del dispositivo del evento. La del dispositivo (TYPE) si la tiene, y si se define por interfaz
+// (clase 0) la de la interfaz del evento o la primera de las interfaces que publica udev
+func eventDeviceClass(env map[string]string) string {
+	if deviceClass, found := firstDecimal(env["TYPE"]); found && deviceClass != 0 {
+		return usbClassName(deviceClass)
+	}
+	if ifaceClass, found := firstDecimal(env["INTERFACE"]); found {
+		return usbClassName(ifaceClass)
+	}
+	//":080650:030101:" => 08
+	if interfaces := strings.Trim(env["ID_USB_INTERFACES"], ":"); len(interfaces) >= 2 {
+		if class, err := strconv.ParseUint(interfaces[:2], 16, 8); err == nil {
+			return usbClassName(uint8(class))
+		}
+	}
+	return UNKNOWN
+}
+
+// driver del evento: el de la interfaz USB que publica udev (los discos de usb-storage) o el del propio dispositivo
+func eventDriver(env map[string]string) string {
+	if driver := env["ID_USB_DRIVER"]; driver != "" {
+		return driver
+	}
+	if driver := env["DRIVER"]; driver != "" {
+		return driver
+	}
+	return UNKNOWN
+}
+
+// drivers de las interfaces del dispositivo en sysfs (<devicesDir>/1-2:1.0/driver -> .../usbhid). El evento usb_device
+// solo trae el driver generico "usb", y las interfaces se enlazan a su driver despues. Vacio si no hay ninguno
+func sysfsInterfaceDrivers(devicesDir, sysfsName string) string {
+	links, err := filepath.Glob(filepath.Join(devicesDir, sysfsName+":*", "driver"))
+	if err != nil {
+		return ""
+	}
+	var drivers []string
+	for _, link := range links {
+		target, err := os.Readlink(link)
+		if err != nil {
+			continue
+		}
+		if driver := filepath.Base(target); !slices.Contains(drivers, driver) {
+			drivers = append(drivers, driver)
+		}
+	}
+	slices.Sort(drivers)
+	return strings.Join(drivers, ",")
+}
+
+// primer numero de "8/6/80"
+func firstDecimal(value string) (uint8, bool) {
+	first, _, _ := strings.Cut(value, "/")
+	number, err := strconv.ParseUint(first, 10, 8)
+	if err != nil {
+		return 0, false
+	}
+	return uint8(number), true
+}
+
+// vendor y product del evento: los de udev (ID_VENDOR_ID, ID_MODEL_ID) o los del kernel (PRODUCT=46d/c52b/1201)
+func eventUsbIds(env map[string]string) (vendorId, productId string) {
+	if env["ID_VENDOR_ID"] != "" {
+		return env["ID_VENDOR_ID"], env["ID_MODEL_ID"]
+	}
+	parts := strings.Split(env["PRODUCT"], "/")
+	if len(parts) < 2 {
+		return "", ""
+	}
+	vendor, vendorErr := parseUsbId(parts[0])
+	product, productErr := parseUsbId(parts[1])
+	if vendorErr != nil || productErr != nil {
+		return "", ""
+	}
+	return fmt.Sprintf("%04x", vendor), fmt.Sprintf("%04x", product)
+}
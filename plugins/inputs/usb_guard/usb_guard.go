@@ -3,6 +3,8 @@ package usb_guard
 import (
 	_ "embed"
 	"fmt"
+	"path"
+	"path/filepath"
 	"slices"
 	"sort"
 	"strings"
@@ -25,6 +27,8 @@ var sampleConfig string
 
 var eventsTimeout = 5 * time.Second
 
+const defaultSysfsRoot string = "/sys"
+
 type UsbInfo struct {
 	devId         string
 	devName       string
@@ -39,13 +43,21 @@ type UsbInfo struct {
 }
 
 type UsbsGuard struct {
+	Rules       []*UsbRule    `toml:"rules"`     //eventos de udev que se monitorizan. Si esta vacio se usan defaultUsbRules
+	Policy      UsbPolicy     `toml:"policy"`    //dispositivos permitidos y denegados
+	Enforce     EnforceConfig `toml:"enforce"`   //bloqueo en sysfs de los dispositivos no permitidos
+	SysfsRoot   string        `toml:"sysfsRoot"` //raiz de sysfs (drivers de las interfaces y bloqueo), para probar contra un arbol falso
+	policy      *usbPolicy
+	enforcer    *usbEnforcer
+	devicesDir  string //<sysfsRoot>/bus/usb/devices
 	mutexEvents sync.Mutex
 	acc         telegraf.Accumulator
 	Log         telegraf.Logger `toml:"-"`
 	usbCatcher
 }
 type usbCatcher struct {
-	usbRulesMatcher netlink.Matcher
+	usbRulesMatcher netlink.Matcher //eventos que se reciben: los de las reglas y, con bloqueo, los usb_device
+	reportMatcher   netlink.Matcher //eventos que se envian: los de las reglas
 	kernelUsbConn   netlink.UEventConn
 	quitChannel     chan struct{}
 	eventsQueueChan chan usbsPluged
@@ -64,6 +76,13 @@ type UsbDev struct {
 	IdSerialName   string
 	IdSerialShort  string
 	IdFsUuidEnc    string
+	DeviceClass    string `json:"deviceClass"` //clase USB del dispositivo (hid, mass_storage, communications...)
+	Driver         string `json:"driver"`      //driver del kernel (usb-storage, usbhid, cdc_acm...)
+	VendorId       string `json:"vendorId"`    //$ID_VENDOR_ID
+	ProductId      string `json:"productId"`   //$ID_MODEL_ID
+	Policy         string `json:"policy"`      //allowed/denied/unknown. Vacio si no hay politica
+	PolicyRule     string `json:"policyRule"`  //entrada de la politica que decide
+	SysfsName      string `json:"sysfsName"`   //dispositivo en /sys/bus/usb/devices (1-2)
 }
 
 func (us *UsbsGuard) SampleConfig() string {
@@ -72,19 +91,62 @@ func (us *UsbsGuard) SampleConfig() string {
 func (us *UsbsGuard) Init() error {
 	us.Log.Info("Usb events collect initialized")
 	us.kernelUsbConn = netlink.UEventConn{}
-	rules := &netlink.RuleDefinitions{}
-	rules.AddRule(netlink.RuleDefinition{
-		Env: map[string]string{
-			"ID_USB_DRIVER": "usb-storage",
-		},
-	})
+	if len(us.Rules) == 0 {
+		us.Rules = defaultUsbRules
+	}
+	rules, err := compileUsbRules(us.Rules)
+	if err != nil {
+		return err
+	}
 	us.usbRulesMatcher = rules
+	us.reportMatcher = rules
+	if us.SysfsRoot == "" {
+		us.SysfsRoot = defaultSysfsRoot
+	}
+	us.devicesDir = filepath.Join(us.SysfsRoot, "bus", "usb", "devices")
+	if us.Policy.configured() {
+		if us.policy, err = newUsbPolicy(us.Policy); err != nil {
+			return err
+		}
+	}
+	if us.Enforce.Mode == "" {
+		us.Enforce.Mode = ENFORCE_OFF
+	}
+	if us.Enforce.AuthorizedDefault != "" && us.Enforce.Mode != ENFORCE_BLOCK {
+		return fmt.Errorf("enforce: authorizedDefault necesita mode = %q", ENFORCE_BLOCK)
+	}
+	if us.Enforce.Mode != ENFORCE_OFF {
+		if us.policy == nil {
+			return fmt.Errorf("enforce: el bloqueo de dispositivos necesita una política (policy)")
+		}
+		//la politica se aplica con el evento usb_device, antes de que exista ningun sistema de ficheros
+		if entries := us.policy.fsUuidAllowEntries(); len(entries) != 0 {
+			return fmt.Errorf("enforce: las entradas allow %q usan fsUuid, que no se conoce al conectar el dispositivo y nunca lo permitirían. Usa vendorId/productId o serial", entries)
+		}
+		if us.enforcer, err = newUsbEnforcer(us.Enforce, us.devicesDir); err != nil {
+			return err
+		}
+		//el bloqueo necesita los eventos usb_device aunque las reglas no los incluyan
+		if us.usbRulesMatcher, err = compileUsbRules(append(slices.Clone(us.Rules), enforceUsbRule)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 func (us *UsbsGuard) Start(acc telegraf.Accumulator) error {
 	us.acc = acc
 	us.Log.Info("Usb events collect started")
+	if us.enforcer != nil {
+		if err := us.enforcer.applyAuthorizedDefault(); err != nil {
+			return err
+		}
+	}
 	if err := us.kernelUsbConn.Connect(netlink.UdevEvent); err != nil {
+		if us.enforcer != nil {
+			for _, restoreErr := range us.enforcer.restoreAuthorizedDefault() {
+				us.Log.Error(restoreErr)
+			}
+		}
 		return fmt.Errorf("unable to connect to Netlink Kobject UEvent socket: %w", err)
 	}
 	queue := make(chan netlink.UEvent, 2)
@@ -92,10 +154,22 @@ func (us *UsbsGuard) Start(acc telegraf.Accumulator) error {
 	us.eventsQueueChan = make(chan usbsPluged, 10)
 	us.quitChannel = us.kernelUsbConn.Monitor(queue, errors, us.usbRulesMatcher)
 	go us.manageEventQueue()
+	if us.enforcer != nil {
+		//los conectados antes de arrancar no generan eventos. Despues de conectar el socket para no perder ninguno
+		us.enforcePresentDevices()
+	}
 	go func() {
 		for {
 			select {
 			case uvent := <-queue:
+				if us.enforcer != nil && uvent.Action == netlink.ADD && uvent.Env["DEVTYPE"] == "usb_device" {
+					//se bloquea en cuanto llega el evento, sin esperar al lote de eventsTimeout
+					us.enforceNewDevice(uvent)
+				}
+				if !us.reportMatcher.Evaluate(uvent) {
+					//solo llega por las reglas del bloqueo
+					continue
+				}
 				us.mutexEvents.Lock()
 				// log.Println("Device event input: ", uvent.Action)
 				if us.queueTimer == nil {
@@ -104,30 +178,12 @@ func (us *UsbsGuard) Start(acc telegraf.Accumulator) error {
 						now := time.Now()
 						data := usbsPluged{pluggedIn: make(map[string]*UsbDev), pluggedOff: make(map[string]*UsbDev)}
 						for _, ev := range us.eventsQueue {
-							manufacturerId := fmt.Sprintf("%v:%v", ev.Env["ID_MODEL_ID"], ev.Env["ID_VENDOR_ID"])
-							devIface := strings.Replace(ev.Env["DEVNAME"], "/dev/", "", 1)
 							if ev.Action == netlink.ADD {
-								newDevicePlugin := &UsbDev{
-									Timestamp:      now.UnixMilli(),
-									State:          CONNECTED,
-									ManufacturerId: manufacturerId,
-									Interface:      devIface,
-									IdSerialName:   ev.Env["ID_SERIAL"],
-									IdSerialShort:  ev.Env["ID_SERIAL_SHORT"],
-									IdFsUuidEnc:    ev.Env["ID_FS_UUID_ENC"],
-								}
-								data.pluggedIn[devIface] = newDevicePlugin
+								newDevicePlugin := newUsbDev(ev, CONNECTED, now)
+								data.pluggedIn[newDevicePlugin.Interface] = newDevicePlugin
 							} else if ev.Action == netlink.REMOVE {
-								newDevicePlugOff := &UsbDev{
-									Timestamp:      now.UnixMilli(),
-									State:          DISCONNECTED,
-									ManufacturerId: manufacturerId,
-									Interface:      devIface,
-									IdSerialName:   ev.Env["ID_SERIAL"],
-									IdSerialShort:  ev.Env["ID_SERIAL_SHORT"],
-									IdFsUuidEnc:    ev.Env["ID_FS_UUID_ENC"],
-								}
-								data.pluggedOff[devIface] = newDevicePlugOff
+								newDevicePlugOff := newUsbDev(ev, DISCONNECTED, now)
+								data.pluggedOff[newDevicePlugOff.Interface] = newDevicePlugOff
 							}
 						}
 						//enviar los dispositivos
@@ -158,32 +214,77 @@ func (us *UsbsGuard) manageEventQueue() {
 		if len(usbsPlugOff) != 0 {
 			if usbsMetricsOff := parseRawUsbToCompact(usbsPlugOff, DISCONNECTED, true); len(usbsPlugOff) != 0 {
 				us.Log.Info("event usbs removed: ")
-				for _, sysMetric := range usbsMetricsOff {
-					me := sysMetric.TelegrafNormalize()
-					us.Log.Infof("id: %v | iface: %v | state: %v | ts: %v\n", me.GetTags()["id"], me.GetTags()["devnames"], me.Fields["state"], me.GetTime())
-					us.acc.AddFields(me.GetDeviceID(), me.GetFields(), me.GetTags(), me.GetTime())
-				}
+				us.sendDevices(usbsMetricsOff)
 			}
 		}
 		if len(usbsPlugIn) != 0 {
 			if usbsMetricsIn := parseRawUsbToCompact(usbsPlugIn, CONNECTED, true); len(usbsMetricsIn) != 0 {
 				us.Log.Info("event usbs plugin: ")
-				for _, sysMetric := range usbsMetricsIn {
-					me := sysMetric.TelegrafNormalize()
-					us.Log.Infof("id: %v | iface: %v | state: %v | ts: %v\n", me.GetTags()["id"], me.GetTags()["devnames"], me.Fields["state"], me.GetTime())
-					us.acc.AddFields(me.GetDeviceID(), me.GetFields(), me.GetTags(), me.GetTime())
-				}
+				us.sendDevices(usbsMetricsIn)
 			}
 		}
 	}
 }
 
+// evalua la politica de cada dispositivo y lo envia. Los conectados que no estan permitidos generan ademas una alerta.
+// El bloqueo ya se aplico al llegar el evento usb_device (enforceNewDevice), aqui solo se informa
+func (us *UsbsGuard) sendDevices(devices map[string]*UsbDev) {
+	for _, device := range devices {
+		if device.State == CONNECTED && device.SysfsName != "" && (device.Driver == UNKNOWN || device.Driver == "usb") {
+			//las interfaces ya estan enlazadas a su driver cuando se envia el lote
+			if drivers := sysfsInterfaceDrivers(us.devicesDir, device.SysfsName); drivers != "" {
+				device.Driver = drivers
+			}
+		}
+		if us.policy != nil {
+			device.Policy, device.PolicyRule = us.policy.evaluate(device)
+		}
+		me := device.TelegrafNormalize()
+		us.Log.Infof("id: %v | iface: %v | state: %v | policy: %v | ts: %v\n", me.GetTags()["id"], me.GetTags()["devnames"], me.Fields["state"], device.Policy, me.GetTime())
+		us.acc.AddFields(me.GetDeviceID(), me.GetFields(), me.GetTags(), me.GetTime())
+		if us.policy != nil && device.State == CONNECTED && device.Policy != POLICY_ALLOWED {
+			us.Log.Warnf("dispositivo no permitido: %v (%v) | vendor:product %v:%v | clase: %v | política: %v %v", me.GetTags()["id"], device.Interface, device.VendorId, device.ProductId, device.DeviceClass, device.Policy, device.PolicyRule)
+			violation := (&usbPolicyViolation{device: device}).TelegrafNormalize()
+			us.acc.AddFields(violation.GetDeviceID(), violation.GetFields(), violation.GetTags(), violation.GetTime())
+		}
+	}
+}
+
+// dispositivo de un evento de udev
+func newUsbDev(ev netlink.UEvent, state string, now time.Time) *UsbDev {
+	devIface := strings.Replace(ev.Env["DEVNAME"], "/dev/", "", 1)
+	if devIface == "" {
+		//interfaces usb y dispositivos sin nodo en /dev: nombre en sysfs (1-2:1.0)
+		devIface = path.Base(ev.Env["DEVPATH"])
+	}
+	vendorId, productId := eventUsbIds(ev.Env)
+	return &UsbDev{
+		Timestamp:      now.UnixMilli(),
+		State:          state,
+		ManufacturerId: fmt.Sprintf("%v:%v", ev.Env["ID_MODEL_ID"], ev.Env["ID_VENDOR_ID"]),
+		Interface:      devIface,
+		IdSerialName:   ev.Env["ID_SERIAL"],
+		IdSerialShort:  ev.Env["ID_SERIAL_SHORT"],
+		IdFsUuidEnc:    ev.Env["ID_FS_UUID_ENC"],
+		DeviceClass:    eventDeviceClass(ev.Env),
+		Driver:         eventDriver(ev.Env),
+		VendorId:       vendorId,
+		ProductId:      productId,
+		SysfsName:      usbSysfsName(ev.Env["DEVPATH"]),
+	}
+}
+
 func (us *UsbsGuard) Gather(_ telegraf.Accumulator) error {
 	return nil
 }
 func (us *UsbsGuard) Stop() {
 	close(us.quitChannel)
 	us.kernelUsbConn.Close()
+	if us.enforcer != nil {
+		for _, err := range us.enforcer.restoreAuthorizedDefault() {
+			us.Log.Error(err)
+		}
+	}
 	us.Log.Info("usb monitor stopped")
 }
 
@@ -195,7 +296,8 @@ func parseRawUsbToCompact(rawDevices map[string]*UsbDev, status string, removeIn
 		if slices.Contains(deviceAlreadyChecked, iKey) {
 			continue
 		}
-		if (i.IdSerialShort == "" && i.IdFsUuidEnc == "") || i.IdSerialName == "" || i.ManufacturerId == "" {
+		//teclados, adaptadores de red... no suelen tener numero de serie: basta con el ID_SERIAL de udev
+		if i.IdSerialName == "" || i.ManufacturerId == "" {
 			continue
 		}
 		finalUsbGrouped[iKey] = append(finalUsbGrouped[iKey], i)
@@ -217,6 +319,8 @@ func parseRawUsbToCompact(rawDevices map[string]*UsbDev, status string, removeIn
 		var idFs string
 		var idSerialShort string
 		var ifaces []string
+		deviceClass, driver := UNKNOWN, UNKNOWN
+		var vendorId, productId, sysfsName string
 		manufacturerId := usbsWithSameId[0].ManufacturerId
 		idSerialName := usbsWithSameId[0].IdSerialName
 
@@ -231,6 +335,19 @@ func parseRawUsbToCompact(rawDevices map[string]*UsbDev, status string, removeIn
 			if usb.IdSerialShort != "" {
 				idSerialShort = usb.IdSerialShort
 			}
+			//el usb_device trae la clase, y el disco el driver de la interfaz (usb-storage) en lugar del generico "usb"
+			if usb.DeviceClass != "" && usb.DeviceClass != UNKNOWN {
+				deviceClass = usb.DeviceClass
+			}
+			if usb.Driver != "" && usb.Driver != UNKNOWN && (driver == UNKNOWN || driver == "usb") {
+				driver = usb.Driver
+			}
+			if usb.VendorId != "" {
+				vendorId, productId = usb.VendorId, usb.ProductId
+			}
+			if usb.SysfsName != "" {
+				sysfsName = usb.SysfsName
+			}
 			ifaces = append(ifaces, usb.Interface)
 			sort.Strings(ifaces)
 		}
@@ -242,6 +359,11 @@ func parseRawUsbToCompact(rawDevices map[string]*UsbDev, status string, removeIn
 			IdSerialShort:  idSerialShort,
 			IdFsUuidEnc:    idFs,
 			Interface:      strings.Join(ifaces, ":"),
+			DeviceClass:    deviceClass,
+			Driver:         driver,
+			VendorId:       vendorId,
+			ProductId:      productId,
+			SysfsName:      sysfsName,
 		}
 		finalCompatUsbs[strings.Join(ifaces, ":")] = usb
 	}
@@ -249,13 +371,7 @@ func parseRawUsbToCompact(rawDevices map[string]*UsbDev, status string, removeIn
 }
 
 func (u *UsbDev) TelegrafNormalize() system_utils.TelegrafEvent {
-	devUiid := fmt.Sprintf("%v:%v", u.IdSerialShort, u.IdFsUuidEnc)
-	tags := map[string]string{
-		"group":        "USBS",
-		"id":           devUiid,
-		"devnames":     u.Interface,
-		"manufacturer": u.ManufacturerId,
-	}
+	tags := u.deviceTags()
 	fields := map[string]interface{}{
 		"state": u.State,
 	}
@@ -267,8 +383,24 @@ func (u *UsbDev) TelegrafNormalize() system_utils.TelegrafEvent {
 	}
 }
 
+func (u *UsbDev) deviceTags() map[string]string {
+	devUiid := fmt.Sprintf("%v:%v", u.IdSerialShort, u.IdFsUuidEnc)
+	tags := map[string]string{
+		"group":        "USBS",
+		"id":           devUiid,
+		"devnames":     u.Interface,
+		"manufacturer": u.ManufacturerId,
+		"device_class": u.DeviceClass,
+		"driver":       u.Driver,
+	}
+	if u.Policy != "" {
+		tags["policy"] = u.Policy
+	}
+	return tags
+}
+
 func init() {
 	inputs.Add("usb_guard", func() telegraf.Input {
-		return &UsbsGuard{}
+		return &UsbsGuard{Enforce: defaultEnforceConfig, SysfsRoot: defaultSysfsRoot}
 	})
 }